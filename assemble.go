@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+)
+
+// assembler combines the blocks extracted from all inputs to the outputs
+type assembler struct {
+	output map[string]script
+	policy conflictPolicy
+	// Directory for the temporary files of streamed text outputs, empty if
+	// nothing is streamed. Outputs for which keep is true are never
+	// streamed, and spoolBuf is shared by all of them.
+	streamDir string
+	keep      func(script) bool
+	spoolBuf  *bufio.Writer
+	// Put the outputs of every input into its own directory, unless they
+	// are merged. The directory of the input currently assembled, and the
+	// inputs by their directory.
+	inputDirs bool
+	dir       string
+	dirs      map[string]string
+	// Name of the input currently assembled, and errors found so far
+	inputName string
+	errs      errorList
+}
+
+func newAssembler(policy conflictPolicy) *assembler {
+	return &assembler{
+		output: make(map[string]script),
+		policy: policy,
+		dirs:   make(map[string]string),
+	}
+}
+
+// report adds the input to a diagnostic. Errors are collected, everything
+// else is logged.
+func (a *assembler) report(d diagnostic) {
+	d.input = a.inputName
+	if d.severity == severityError {
+		a.errs = append(a.errs, d)
+	} else {
+		log.diagnose(d)
+	}
+}
+
+// declare adds the attributes of a block to the output at path. The
+// returned bool is false, if the output was declared as another kind.
+func (a *assembler) declare(b block) (script, bool) {
+	p := b.attrs.path
+	sc, exists := a.output[p]
+	if exists && sc.attrs.kind != b.attrs.kind {
+		d := newDiagnostic(severityError, codeKindConflict,
+			"declared as %s, but already declared as %s", b.attrs.kind, sc.attrs.kind)
+		d.output = p
+		d.line = b.line
+		a.report(d)
+		return sc, false
+	}
+	sc.attrs.kind = b.attrs.kind
+
+	for _, conflict := range sc.declare(b.attrs, a.policy) {
+		d := newDiagnostic(severityError, codeAttributeConflict, "%s", conflict)
+		d.output = p
+		d.line = b.line
+		if a.policy != conflictError {
+			d.severity = severityWarning
+			d.message += fmt.Sprintf(", using %s", a.policy)
+		}
+		a.report(d)
+	}
+	return sc, true
+}
+
+// addExtracted assembles the result of extracting an input, and logs how
+// the cache was used.
+func (a *assembler) addExtracted(name string, result extracted) {
+	if result.cached {
+		log.verbose2f("Using cached blocks of %s\n", name)
+	}
+	if result.cacheErr != nil {
+		d := newDiagnostic(severityWarning, codeCacheFailed, "%v", result.cacheErr)
+		d.input = name
+		log.diagnose(d)
+	}
+	a.add(name, result.extraction)
+}
+
+// add assembles everything extracted from one input
+func (a *assembler) add(name string, ex extraction) {
+	a.inputName = name
+	for _, d := range ex.diagnostics {
+		a.report(d)
+	}
+	if a.inputDirs {
+		a.setInputDir(name, ex.dir)
+	}
+	for _, b := range ex.blocks {
+		if a.dir != "" && !b.attrs.merged {
+			b.attrs.path = path.Join(a.dir, b.attrs.path)
+		}
+		if b.attrs.kind == outputFile {
+			a.addFile(b)
+			continue
+		}
+		log.verbose3f("Adding %s '%s'\n", b.attrs.kind, b.attrs.path)
+		if sc, ok := a.declare(b); ok {
+			a.output[b.attrs.path] = sc
+		}
+	}
+}
+
+func (a *assembler) addFile(b block) {
+	p := b.attrs.path
+	_, exists := a.output[p]
+	if !exists && b.attrs.lineEnding == lineEndingUnknown {
+		// The first block defines the line ending, if none was specified
+		b.attrs.lineEnding = b.lineEnding
+	}
+
+	if existing := a.output[p]; exists && existing.attrs.kind == outputFile &&
+		b.attrs.encoding != encodingUnknown && b.attrs.encoding.isBinary() != existing.attrs.encoding.isBinary() {
+		// Binary and text content can't be combined, there is no line
+		// ending between them, and streamed text is written separately
+		d := newDiagnostic(severityError, codeEncodingConflict,
+			"encoding=%s is %s, but previous blocks are %s",
+			b.attrs.encoding, encodingClass(b.attrs.encoding), encodingClass(existing.attrs.encoding))
+		d.output = p
+		d.line = b.line
+		a.report(d)
+		return
+	}
+
+	sc, ok := a.declare(b)
+	if !ok {
+		return
+	}
+	log.verbose3f("Adding script '%s' with line ending '%s'\n", p, sc.attrs.lineEnding.String())
+	if sc.language == "" {
+		sc.language = b.language
+	}
+
+	lines := b.lines
+	if sc.attrs.encoding.isBinary() {
+		// Binary content is decoded as is, without any line ending conversion
+		data, index, err := sc.attrs.encoding.decode(lines)
+		if err != nil {
+			d := newDiagnostic(severityError, codeInvalidData, "%v", err)
+			d.output = p
+			d.line = b.line + b.start + index
+			a.report(d)
+			return
+		}
+		sc.content = append(sc.content, data...)
+		a.output[p] = sc
+		return
+	}
+
+	if b.attrs.dedent {
+		lines = dedent(lines)
+	}
+	if !exists && a.streams(sc) {
+		if err := a.startSpool(&sc); err != nil {
+			a.reportWriteFailed(p, err)
+			return
+		}
+	}
+	if len(lines) > 0 {
+		line := bytes.Count(sc.content, sc.attrs.lineEnding.bytes()) + 1
+		if sc.streamed {
+			line = sc.spool.lines + 1
+		}
+		sc.origins = append(sc.origins, origin{
+			line:      line,
+			input:     a.inputName,
+			inputLine: b.line + b.start,
+		})
+	}
+	if sc.streamed {
+		if err := sc.spool.append(a.spoolBuf, lines); err != nil {
+			a.reportWriteFailed(p, err)
+		}
+	} else {
+		for _, line := range lines {
+			sc.append(line)
+		}
+	}
+	a.output[p] = sc
+}
+
+// streams is true if a text output is written to a temporary file instead
+// of keeping its content, which is decided by its first block.
+func (a *assembler) streams(sc script) bool {
+	return a.streamDir != "" && (a.keep == nil || !a.keep(sc))
+}
+
+func (a *assembler) startSpool(sc *script) error {
+	spool, err := newSpoolFile(a.streamDir)
+	if err != nil {
+		return err
+	}
+	if a.spoolBuf == nil {
+		a.spoolBuf = bufio.NewWriterSize(nil, 64*1024)
+	}
+	sc.streamed = true
+	sc.spool = spool
+	return nil
+}
+
+func (a *assembler) reportWriteFailed(p string, err error) {
+	d := newDiagnostic(severityError, codeWriteFailed, "%v", err)
+	d.output = p
+	a.report(d)
+}
+
+// encodingClass names whether an encoding is for binary or text content
+func encodingClass(enc textEncoding) string {
+	if enc.isBinary() {
+		return "binary"
+	}
+	return "text"
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// conflictPolicy decides what happens, if blocks of the same file declare
+// different attributes.
+type conflictPolicy int8
+
+const (
+	conflictFirstWins conflictPolicy = iota
+	conflictLastWins
+	conflictError
+)
+
+func (policy conflictPolicy) String() string {
+	switch policy {
+	case conflictLastWins:
+		return "last-wins"
+	case conflictError:
+		return "error"
+	default:
+		return "first-wins"
+	}
+}
+
+func parseConflictPolicy(policy string) (conflictPolicy, error) {
+	switch policy {
+	case "first-wins", "":
+		return conflictFirstWins, nil
+	case "last-wins":
+		return conflictLastWins, nil
+	case "error":
+		return conflictError, nil
+	default:
+		return conflictFirstWins, fmt.Errorf("invalid conflict policy '%s'", policy)
+	}
+}
+
+// blockAttributes describe how a code block is written to its output file.
+// They are either given by the FILE pragma on the first line of a block, or
+// as attributes in the info string of a fenced code block:
+//
+//	```sh {file=setup.sh eol=lf mode=0755}
+type blockAttributes struct {
+	kind       outputKind
+	path       string
+	target     string
+	lineEnding lineEndingStyle
+	mode       os.FileMode
+	dedent     bool
+	// Write to the shared output directory, even if every input has its own
+	merged     bool
+	encoding   textEncoding
+	whitespace whitespaceAttributes
+}
+
+var attributeListRE = regexp.MustCompile(`\{([^}]*)\}`)
+var attributeRE = regexp.MustCompile(`([A-Za-z][\w-]*)=(?:"([^"]*)"|(\S+))`)
+var hiddenPragmaRE = regexp.MustCompile(`^\s*<!--\s*markli:((?s).*?)-->\s*$`)
+
+// parseAttributeList returns all key=value pairs of the first {...} list
+// in input, in the order they were given. Values can be double-quoted
+// to include spaces.
+func parseAttributeList(input []byte) [][2]string {
+	list := attributeListRE.FindSubmatch(input)
+	if list == nil {
+		return nil
+	}
+	return parseAttributes(list[1])
+}
+
+func parseAttributes(input []byte) [][2]string {
+	var result [][2]string
+	for _, match := range attributeRE.FindAllSubmatch(input, -1) {
+		value := match[3]
+		if value == nil {
+			value = match[2]
+		}
+		result = append(result, [2]string{string(match[1]), string(value)})
+	}
+	return result
+}
+
+func parseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode '%s'", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (a *blockAttributes) set(key, value string) error {
+	if ok, err := a.whitespace.set(key, value); ok {
+		return err
+	}
+
+	switch key {
+	case "file":
+		a.kind = outputFile
+		a.path = normalizePath(value)
+	case "dir":
+		a.kind = outputDir
+		a.path = normalizePath(value)
+	case "link":
+		a.kind = outputLink
+		a.path = normalizePath(value)
+	case "target":
+		a.target = normalizePath(value)
+	case "eol":
+		ending := parseLineEndingStyle(strings.ToUpper(value))
+		if ending == lineEndingUnknown {
+			return fmt.Errorf("invalid line ending '%s'", value)
+		}
+		a.lineEnding = ending
+	case "mode":
+		mode, err := parseFileMode(value)
+		if err != nil {
+			return err
+		}
+		a.mode = mode
+	case "encoding":
+		encoding := parseTextEncoding(value)
+		if encoding == encodingUnknown {
+			return fmt.Errorf("invalid encoding '%s'", value)
+		}
+		a.encoding = encoding
+	case "dedent":
+		dedent, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for dedent '%s'", value)
+		}
+		a.dedent = dedent
+	case "merge":
+		merge, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for merge '%s'", value)
+		}
+		a.merged = merge
+	default:
+		return fmt.Errorf("unknown attribute '%s'", key)
+	}
+	return nil
+}
+
+// values returns all declared attributes, which apply to the whole file,
+// in the same format accepted by set.
+func (a *blockAttributes) values() map[string]string {
+	values := make(map[string]string)
+	if a.target != "" {
+		values["target"] = a.target
+	}
+	if a.lineEnding != lineEndingUnknown {
+		values["eol"] = strings.ToLower(a.lineEnding.String())
+	}
+	if a.mode != 0 {
+		values["mode"] = fmt.Sprintf("%04o", a.mode)
+	}
+	if a.encoding != encodingUnknown {
+		values["encoding"] = a.encoding.String()
+	}
+	a.whitespace.values(values)
+	return values
+}
+
+// merge declares the attributes of another block of the same file. If an
+// attribute was already declared with a different value, the policy decides
+// which one is used. All such conflicts are returned.
+func (a *blockAttributes) merge(other blockAttributes, policy conflictPolicy) []string {
+	current := a.values()
+	declared := other.values()
+
+	keys := make([]string, 0, len(declared))
+	for key := range declared {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var conflicts []string
+	for _, key := range keys {
+		value := declared[key]
+		if old, ok := current[key]; ok {
+			if old == value {
+				continue
+			}
+			conflicts = append(conflicts, fmt.Sprintf("%s=%s conflicts with %s=%s", key, value, key, old))
+			if policy != conflictLastWins {
+				continue
+			}
+		}
+		// values are always valid
+		_ = a.set(key, value)
+	}
+	return conflicts
+}
+
+// invalidAttribute is the warning about an attribute which is skipped
+func invalidAttribute(err error) diagnostic {
+	return newDiagnostic(severityWarning, codeInvalidAttribute, "%v, ignoring it", err)
+}
+
+// parseInfoAttributes extracts the block attributes from the info string
+// of a fenced code block, invalid attributes are skipped with a warning.
+func parseInfoAttributes(info []byte) (blockAttributes, []diagnostic) {
+	var attrs blockAttributes
+	var warnings []diagnostic
+	for _, kv := range parseAttributeList(info) {
+		if err := attrs.set(kv[0], kv[1]); err != nil {
+			warnings = append(warnings, invalidAttribute(err))
+		}
+	}
+	return attrs, warnings
+}
+
+// parseHiddenPragma parses the attributes of a markli HTML comment like
+// <!-- markli: file=hello.sh eol=lf -->, invalid attributes are skipped
+// with a warning.
+func parseHiddenPragma(html []byte) (blockAttributes, []diagnostic, bool) {
+	var attrs blockAttributes
+	var warnings []diagnostic
+	match := hiddenPragmaRE.FindSubmatch(html)
+	if match == nil {
+		return attrs, nil, false
+	}
+	for _, kv := range parseAttributes(match[1]) {
+		if err := attrs.set(kv[0], kv[1]); err != nil {
+			warnings = append(warnings, invalidAttribute(err))
+		}
+	}
+	if attrs.path == "" {
+		warnings = append(warnings, newDiagnostic(severityWarning, codeMissingFile,
+			"markli comment without file attribute, ignoring it"))
+		return attrs, warnings, false
+	}
+	return attrs, warnings, true
+}
@@ -0,0 +1,114 @@
+// Benchmarks for rendering and writing multi-megabyte documents, e.g.
+//   go test -run '^$' -bench . -benchmem
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// seedDocument generates a document with a large SQL seed file split into
+// blocks of 1000 lines, like documents generating test data.
+func seedDocument(blocks int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Seed data\n\n")
+	for i := 0; i < blocks; i++ {
+		fmt.Fprintf(&buf, "Part %d of the seed data:\n\n```sql {file=seed.sql trim-trailing=true}\n", i+1)
+		for j := 0; j < 1000; j++ {
+			id := i*1000 + j
+			fmt.Fprintf(&buf, "INSERT INTO users (id, name, email) VALUES (%d, 'user %d', 'user%d@example.com');\n", id, id, id)
+		}
+		buf.WriteString("```\n\n")
+	}
+	return buf.Bytes()
+}
+
+func benchmarkRender(b *testing.B, inputs [][]byte, opts renderOptions) {
+	size := 0
+	for _, input := range inputs {
+		size += len(input)
+	}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if opts.stream {
+			// A new directory every time, so the temporary files don't add up
+			b.StopTimer()
+			dir, err := ioutil.TempDir(baseDir, b.Name())
+			if err != nil {
+				b.Fatal(err)
+			}
+			opts.streamDir = dir
+			b.StartTimer()
+		}
+		if _, err := render(inputs, opts); err != nil {
+			b.Fatal(err)
+		}
+		if opts.stream {
+			b.StopTimer()
+			os.RemoveAll(opts.streamDir)
+			b.StartTimer()
+		}
+	}
+}
+
+func BenchmarkExtract(b *testing.B) {
+	input := seedDocument(100)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	ext := newExtractor()
+	for i := 0; i < b.N; i++ {
+		ext.extract(input)
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	benchmarkRender(b, [][]byte{seedDocument(100)}, renderOptions{})
+}
+
+func BenchmarkRenderStreamed(b *testing.B) {
+	benchmarkRender(b, [][]byte{seedDocument(100)}, renderOptions{stream: true})
+}
+
+func BenchmarkRenderInputs(b *testing.B) {
+	var inputs [][]byte
+	for i := 0; i < 16; i++ {
+		inputs = append(inputs, seedDocument(10))
+	}
+	benchmarkRender(b, inputs, renderOptions{})
+}
+
+func benchmarkProcess(b *testing.B, opts renderOptions) {
+	dir, err := ioutil.TempDir(baseDir, b.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := dir + "/seed.md"
+	content := seedDocument(100)
+	if err := ioutil.WriteFile(input, content, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A new directory every time, so the output is always written
+		out := fmt.Sprintf("%s/out%d", dir, i)
+		if err := process([]string{input}, out, opts, defaultManifestName); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcess(b *testing.B) {
+	benchmarkProcess(b, renderOptions{})
+}
+
+func BenchmarkProcessStreamed(b *testing.B) {
+	benchmarkProcess(b, renderOptions{stream: true})
+}
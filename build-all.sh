@@ -1,12 +1,14 @@
 #!/bin/bash -e
 
+version=$(git describe --tags --always --dirty)
+
 function build() {
     local os=$1
     local arch=$2
     local suffix=$3
     filename="markli-${os}-${arch}${suffix}"
     echo "Building ${filename}"
-    GOOS=$os GOARCH=$arch go build -o dist/${filename} 
+    GOOS=$os GOARCH=$arch go build -ldflags "-X main.version=${version}" -o dist/${filename}
 }
 
 build windows 386 .exe
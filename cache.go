@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// version of markli, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// cacheFormat is part of the cache key, it has to be changed whenever the
+// extraction of blocks changes, so development builds don't use stale entries.
+const cacheFormat = 3
+
+// renderCache stores the blocks extracted from every input in a directory,
+// keyed by the content of the input and the markli version. Unchanged
+// inputs don't need to be parsed again. All methods can be called on a nil
+// cache, which never contains anything.
+type renderCache struct {
+	dir string
+}
+
+func newRenderCache(dir string) *renderCache {
+	return &renderCache{dir: dir}
+}
+
+// Exported copies of block and diagnostic, as gob only encodes exported fields
+type cachedBlock struct {
+	Kind       outputKind
+	Path       string
+	Attributes map[string]string
+	Dedent     bool
+	Merged     bool
+	Line       int
+	Start      int
+	Lines      [][]byte
+	LineEnding lineEndingStyle
+	Language   string
+}
+
+type cachedDiagnostic struct {
+	Severity   severity
+	Code       string
+	Message    string
+	Line       int
+	Output     string
+	SkipsBlock bool
+}
+
+type cachedExtraction struct {
+	Blocks      []cachedBlock
+	Diagnostics []cachedDiagnostic
+	Dir         string
+}
+
+func (c *renderCache) path(input []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00", version, cacheFormat)
+	h.Write(input)
+	return filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil))+".gob")
+}
+
+// load returns the blocks extracted from input before, the bool is false if
+// there is no usable entry. Invalid entries are treated as missing, and
+// replaced by the next store.
+func (c *renderCache) load(input []byte) (extraction, bool) {
+	if c == nil {
+		return extraction{}, false
+	}
+	data, err := ioutil.ReadFile(c.path(input))
+	if err != nil {
+		return extraction{}, false
+	}
+	var cached cachedExtraction
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cached); err != nil {
+		return extraction{}, false
+	}
+
+	ex := extraction{dir: cached.Dir}
+	for _, cb := range cached.Blocks {
+		b := block{
+			attrs: blockAttributes{
+				kind:   cb.Kind,
+				path:   cb.Path,
+				dedent: cb.Dedent,
+				merged: cb.Merged,
+			},
+			line:       cb.Line,
+			start:      cb.Start,
+			lines:      cb.Lines,
+			lineEnding: cb.LineEnding,
+			language:   cb.Language,
+		}
+		for key, value := range cb.Attributes {
+			if err := b.attrs.set(key, value); err != nil {
+				return extraction{}, false
+			}
+		}
+		ex.blocks = append(ex.blocks, b)
+	}
+	for _, cd := range cached.Diagnostics {
+		d := newDiagnostic(cd.Severity, cd.Code, "%s", cd.Message)
+		d.line = cd.Line
+		d.output = cd.Output
+		d.skipsBlock = cd.SkipsBlock
+		ex.diagnostics = append(ex.diagnostics, d)
+	}
+	return ex, true
+}
+
+// store adds the blocks extracted from input to the cache. The entry is
+// written to a temporary file first, so concurrent builds never read
+// incomplete entries.
+func (c *renderCache) store(input []byte, ex extraction) error {
+	if c == nil {
+		return nil
+	}
+
+	cached := cachedExtraction{Dir: ex.dir}
+	for _, b := range ex.blocks {
+		cached.Blocks = append(cached.Blocks, cachedBlock{
+			Kind:       b.attrs.kind,
+			Path:       b.attrs.path,
+			Attributes: b.attrs.values(),
+			Dedent:     b.attrs.dedent,
+			Merged:     b.attrs.merged,
+			Line:       b.line,
+			Start:      b.start,
+			Lines:      b.lines,
+			LineEnding: b.lineEnding,
+			Language:   b.language,
+		})
+	}
+	for _, d := range ex.diagnostics {
+		cached.Diagnostics = append(cached.Diagnostics, cachedDiagnostic{
+			Severity:   d.severity,
+			Code:       d.code,
+			Message:    d.message,
+			Line:       d.line,
+			Output:     d.output,
+			SkipsBlock: d.skipsBlock,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cached); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, "entry-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(input))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
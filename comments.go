@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// commentPragmaRE builds a regex matching a FILE pragma wrapped in a
+// comment, start and end are regular expressions themselves.
+func commentPragmaRE(start, end string) *regexp.Regexp {
+	return regexp.MustCompile(`^\s*` + start + `\s*FILE(-CR|-LF|-CRLF)?:(.*?)\s*` + end + `\s*$`)
+}
+
+var (
+	slashPragmaRE     = commentPragmaRE(`//`, ``)
+	cBlockPragmaRE    = commentPragmaRE(`/\*`, `\*/`)
+	dashPragmaRE      = commentPragmaRE(`--`, ``)
+	remPragmaRE       = commentPragmaRE(`(?i:@?rem)\s`, ``)
+	labelPragmaRE     = commentPragmaRE(`::`, ``)
+	xmlPragmaRE       = commentPragmaRE(`<!--`, `-->`)
+	psBlockPragmaRE   = commentPragmaRE(`<#`, `#>`)
+	semicolonPragmaRE = commentPragmaRE(`;`, ``)
+)
+
+var (
+	cComments     = []*regexp.Regexp{slashPragmaRE, cBlockPragmaRE}
+	dashComments  = []*regexp.Regexp{dashPragmaRE}
+	batchComments = []*regexp.Regexp{remPragmaRE, labelPragmaRE}
+	xmlComments   = []*regexp.Regexp{xmlPragmaRE}
+)
+
+// Comment syntaxes which may contain a FILE pragma, by language tag of the
+// code block. The ### pragma is accepted for every language, and already is
+// a comment wherever # starts one, so # FILE is not accepted.
+var languageComments = map[string][]*regexp.Regexp{
+	"powershell": {psBlockPragmaRE},
+	"ps1":        {psBlockPragmaRE},
+	"pwsh":       {psBlockPragmaRE},
+
+	"c":          cComments,
+	"c++":        cComments,
+	"cpp":        cComments,
+	"cs":         cComments,
+	"csharp":     cComments,
+	"go":         cComments,
+	"groovy":     cComments,
+	"java":       cComments,
+	"javascript": cComments,
+	"js":         cComments,
+	"json":       cComments,
+	"json5":      cComments,
+	"jsonc":      cComments,
+	"kotlin":     cComments,
+	"php":        cComments,
+	"rust":       cComments,
+	"scala":      cComments,
+	"swift":      cComments,
+	"ts":         cComments,
+	"typescript": cComments,
+
+	"css":  {cBlockPragmaRE},
+	"less": cComments,
+	"scss": cComments,
+
+	"haskell": dashComments,
+	"lua":     dashComments,
+	"mysql":   dashComments,
+	"pgsql":   dashComments,
+	"plsql":   dashComments,
+	"sql":     dashComments,
+
+	"bat":   batchComments,
+	"batch": batchComments,
+	"cmd":   batchComments,
+
+	"html":     xmlComments,
+	"markdown": xmlComments,
+	"md":       xmlComments,
+	"svg":      xmlComments,
+	"xhtml":    xmlComments,
+	"xml":      xmlComments,
+
+	"ini": {semicolonPragmaRE},
+	"reg": {semicolonPragmaRE},
+}
+
+func matchPragma(re *regexp.Regexp, input []byte) (string, lineEndingStyle) {
+	ending := lineEndingUnknown
+	if match := re.FindSubmatch(input); match != nil {
+		desiredEnding := match[1]
+		if len(desiredEnding) > 0 {
+			// Cut the - from -CRLF
+			ending = parseLineEndingStyle(string(desiredEnding[1:]))
+		}
+		p := normalizePath(string(match[2]))
+		return p, ending
+	}
+	return "", ending
+}
+
+// parseLanguagePragma parses the ### FILE pragma, or a FILE pragma using
+// the comment syntax of the given language.
+func parseLanguagePragma(input []byte, language string) (string, lineEndingStyle) {
+	if p, ending := parsePragma(input); p != "" {
+		return p, ending
+	}
+	for _, re := range languageComments[strings.ToLower(language)] {
+		if p, ending := matchPragma(re, input); p != "" {
+			return p, ending
+		}
+	}
+	return "", lineEndingUnknown
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the project configuration file, in order of precedence.
+var configFileNames = []string{"markli.yaml", "markli.yml", ".markli.yaml"}
+
+type targetOptions struct {
+	Verbose           int    `yaml:"verbose"`
+	FinalNewline      bool   `yaml:"final-newline"`
+	TrimTrailing      bool   `yaml:"trim-trailing"`
+	StripLeadingBlank bool   `yaml:"strip-leading-blank"`
+	ExpandTabs        int    `yaml:"expand-tabs"`
+	UnexpandTabs      int    `yaml:"unexpand-tabs"`
+	Conflicts         string `yaml:"conflicts"`
+	WarnCollisions    bool   `yaml:"warn-collisions"`
+	Validate          bool   `yaml:"validate"`
+	Stream            bool   `yaml:"stream"`
+	InputDirs         bool   `yaml:"input-dirs"`
+	Manifest          string `yaml:"manifest"`
+}
+
+func (o *targetOptions) renderOptions() renderOptions {
+	// Validated by parseConfig
+	policy, _ := parseConflictPolicy(o.Conflicts)
+	return renderOptions{
+		whitespace: whitespaceOptions{
+			finalNewline:      o.FinalNewline,
+			trimTrailing:      o.TrimTrailing,
+			stripLeadingBlank: o.StripLeadingBlank,
+			expandTabs:        o.ExpandTabs,
+			unexpandTabs:      o.UnexpandTabs,
+		},
+		conflicts:      policy,
+		warnCollisions: o.WarnCollisions,
+		validate:       o.Validate,
+		stream:         o.Stream,
+		inputDirs:      o.InputDirs,
+	}
+}
+
+type target struct {
+	Name    string        `yaml:"-"`
+	Inputs  []string      `yaml:"inputs"`
+	OutDir  string        `yaml:"out-dir"`
+	Tags    []string      `yaml:"tags"`
+	Options targetOptions `yaml:"options"`
+}
+
+type config struct {
+	// Directory containing the configuration file, relative paths
+	// in the targets are resolved against it.
+	dir        string
+	Targets    map[string]*target   `yaml:"targets"`
+	Validators []*externalValidator `yaml:"validators"`
+	// Directory caching the blocks of unchanged inputs, off if empty
+	Cache string `yaml:"cache"`
+}
+
+func (t *target) hasTag(tag string) bool {
+	for _, tt := range t.Tags {
+		if tt == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseConfig(data []byte, dir string) (*config, error) {
+	cfg := &config{dir: dir}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// Report typos like out_dir, instead of silently ignoring them
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("no targets defined")
+	}
+	for name, t := range cfg.Targets {
+		if t == nil {
+			return nil, fmt.Errorf("target '%s' is empty", name)
+		}
+		if len(t.Inputs) == 0 {
+			return nil, fmt.Errorf("target '%s' has no inputs", name)
+		}
+		if _, err := parseConflictPolicy(t.Options.Conflicts); err != nil {
+			return nil, fmt.Errorf("target '%s': %v", name, err)
+		}
+		t.Name = name
+		if t.OutDir == "" {
+			t.OutDir = "."
+		}
+	}
+	for _, v := range cfg.Validators {
+		if v == nil {
+			return nil, fmt.Errorf("empty validator")
+		}
+		if err := v.init(dir); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// findConfig looks for a configuration file in dir and returns its path,
+// or an empty string if there is none.
+func findConfig(dir string) string {
+	for _, name := range configFileNames {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// resolve makes a path from the configuration file relative to the
+// directory containing the configuration file.
+func (c *config) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.dir, path)
+}
+
+// selectTargets returns the targets matching the given names or tags,
+// sorted by name. Without any names, all targets are returned.
+func (c *config) selectTargets(names []string) ([]*target, error) {
+	var selected []*target
+	for _, t := range c.Targets {
+		if len(names) == 0 {
+			selected = append(selected, t)
+			continue
+		}
+		for _, name := range names {
+			if t.Name == name || t.hasTag(name) {
+				selected = append(selected, t)
+				break
+			}
+		}
+	}
+
+	for _, name := range names {
+		found := false
+		for _, t := range selected {
+			if t.Name == name || t.hasTag(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown target or tag '%s'", name)
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Name < selected[j].Name
+	})
+	return selected, nil
+}
@@ -0,0 +1,142 @@
+// Tests for parsing the project configuration and selecting targets
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testConfig = `
+targets:
+  linux:
+    inputs:
+      - setup.md
+      - linux.md
+    out-dir: out/linux
+    tags: [ci, unix]
+  windows:
+    inputs: [setup.md]
+    tags: [ci]
+    options:
+      verbose: 2
+      final-newline: true
+      expand-tabs: 4
+  docs:
+    inputs: [README.md]
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(testConfig), "project")
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(cfg.Targets) == 3)
+
+	linux := cfg.Targets["linux"]
+	assert.Assert(t, linux.Name == "linux")
+	assert.DeepEqual(t, linux.Inputs, []string{"setup.md", "linux.md"})
+	assert.Assert(t, linux.OutDir == "out/linux")
+
+	windows := cfg.Targets["windows"]
+	assert.Assert(t, windows.OutDir == ".")
+	assert.Assert(t, windows.Options.Verbose == 2)
+
+	opts := windows.Options.renderOptions()
+	assert.Assert(t, opts.whitespace.finalNewline)
+	assert.Assert(t, !opts.whitespace.trimTrailing)
+	assert.Assert(t, opts.whitespace.expandTabs == 4)
+
+	assert.Assert(t, cfg.resolve("setup.md") == filepath.Join("project", "setup.md"))
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	_, err := parseConfig([]byte("targets:\n"), ".")
+	assert.Assert(t, err != nil)
+
+	_, err = parseConfig([]byte("targets:\n  empty:\n"), ".")
+	assert.Assert(t, err != nil)
+
+	_, err = parseConfig([]byte("targets:\n  noinputs:\n    out-dir: foo\n"), ".")
+	assert.Assert(t, err != nil)
+
+	_, err = parseConfig([]byte("targets:\n  foo:\n    inputs: [a.md]\n    options:\n      conflicts: random\n"), ".")
+	assert.Assert(t, err != nil)
+
+	_, err = parseConfig([]byte("targets: [foo"), ".")
+	assert.Assert(t, err != nil)
+
+	// Unknown keys are most likely typos
+	_, err = parseConfig([]byte("targets:\n  foo:\n    inputs: [a.md]\n    out_dir: foo\n"), ".")
+	assert.ErrorContains(t, err, "field out_dir not found")
+}
+
+func TestSelectTargets(t *testing.T) {
+	cfg, err := parseConfig([]byte(testConfig), ".")
+	assert.Assert(t, err == nil)
+
+	names := func(targets []*target) []string {
+		var result []string
+		for _, t := range targets {
+			result = append(result, t.Name)
+		}
+		return result
+	}
+
+	all, err := cfg.selectTargets(nil)
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, names(all), []string{"docs", "linux", "windows"})
+
+	byName, err := cfg.selectTargets([]string{"windows"})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, names(byName), []string{"windows"})
+
+	byTag, err := cfg.selectTargets([]string{"ci"})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, names(byTag), []string{"linux", "windows"})
+
+	mixed, err := cfg.selectTargets([]string{"docs", "unix"})
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, names(mixed), []string{"docs", "linux"})
+
+	_, err = cfg.selectTargets([]string{"unknown"})
+	assert.Assert(t, err != nil)
+}
+
+func TestParseConfigValidators(t *testing.T) {
+	config := testConfig + `
+validators:
+  - files: "*.sh"
+    command: shellcheck -f gcc -
+  - files: scripts/*.ps1
+    command: [pwsh, -File, "tools/analyze script.ps1"]
+    pattern: '^line (?P<line>\d+): (?P<message>.*)$'
+`
+	cfg, err := parseConfig([]byte(config), "project")
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(cfg.Validators) == 2)
+
+	sh := cfg.Validators[0]
+	assert.DeepEqual(t, []string(sh.Command), []string{"shellcheck", "-f", "gcc", "-"})
+	assert.Assert(t, sh.dir == "project")
+	assert.Assert(t, sh.matches("setup.sh"))
+	assert.Assert(t, sh.matches("scripts/setup.sh"))
+	assert.Assert(t, !sh.matches("setup.ps1"))
+
+	ps1 := cfg.Validators[1]
+	assert.DeepEqual(t, []string(ps1.Command), []string{"pwsh", "-File", "tools/analyze script.ps1"})
+	assert.Assert(t, ps1.matches("scripts/setup.ps1"))
+	assert.Assert(t, !ps1.matches("setup.ps1"))
+
+	invalid := []string{
+		"validators:\n  - command: shellcheck -\n",
+		"validators:\n  - files: '*.sh'\n",
+		"validators:\n  - files: '*.sh'\n    command: shellcheck\n    pattern: '(?P<line>\\d+)'\n",
+		"validators:\n  - files: '[.sh'\n    command: shellcheck\n",
+	}
+	for _, v := range invalid {
+		_, err = parseConfig([]byte(testConfig+v), ".")
+		assert.Assert(t, err != nil, v)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type severity int8
+
+const (
+	severityError severity = iota
+	severityWarning
+	severityInfo
+)
+
+func (s severity) String() string {
+	switch s {
+	case severityError:
+		return "error"
+	case severityWarning:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// Codes of diagnostics, these are part of the JSON log format and must not
+// be changed.
+const (
+	codeInvalidPath       = "invalid-path"
+	codeInvalidLink       = "invalid-link"
+	codeInvalidAttribute  = "invalid-attribute"
+	codeMissingFile       = "missing-file-attribute"
+	codeOrphanPragma      = "orphan-pragma"
+	codeIgnoredLine       = "ignored-line"
+	codeKindConflict      = "kind-conflict"
+	codeEncodingConflict  = "encoding-conflict"
+	codeAttributeConflict = "attribute-conflict"
+	codeInvalidData       = "invalid-data"
+	codeInvalidSyntax     = "invalid-syntax"
+	codeExternalValidator = "external-validator"
+	codeUnencodable       = "unencodable"
+	codePathCollision     = "path-collision"
+	codeWriteFailed       = "write-failed"
+	codeChecksumMismatch  = "checksum-mismatch"
+	codeMissingOutput     = "missing-output"
+	codeCacheFailed       = "cache-failed"
+)
+
+// diagnostic is a message about the inputs or outputs, located as precisely
+// as possible. Diagnostics with severityError are used as errors.
+type diagnostic struct {
+	severity severity
+	code     string
+	message  string
+	// Name of the markdown input, and the line within it
+	input string
+	line  int
+	// Path of the affected output
+	output string
+	// Set if the code block was ignored because of this diagnostic
+	skipsBlock bool
+}
+
+func newDiagnostic(sev severity, code string, format string, a ...interface{}) diagnostic {
+	return diagnostic{
+		severity: sev,
+		code:     code,
+		message:  fmt.Sprintf(format, a...),
+	}
+}
+
+// Error formats the diagnostic as text, e.g.
+// "setup.sh (line 3, README.md): eol=crlf conflicts with eol=lf".
+func (d diagnostic) Error() string {
+	switch {
+	case d.output != "" && d.input != "" && d.line > 0:
+		return fmt.Sprintf("%s (line %d, %s): %s", d.output, d.line, d.input, d.message)
+	case d.output != "" && d.input != "":
+		return fmt.Sprintf("%s (%s): %s", d.output, d.input, d.message)
+	case d.output != "":
+		return fmt.Sprintf("%s: %s", d.output, d.message)
+	case d.input != "" && d.line > 0:
+		return fmt.Sprintf("%s (line %d): %s", d.input, d.line, d.message)
+	case d.input != "":
+		return fmt.Sprintf("%s: %s", d.input, d.message)
+	default:
+		return d.message
+	}
+}
+
+func (d diagnostic) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Severity string `json:"severity"`
+		Code     string `json:"code,omitempty"`
+		Message  string `json:"message"`
+		Input    string `json:"input,omitempty"`
+		Line     int    `json:"line,omitempty"`
+		Output   string `json:"output,omitempty"`
+	}{d.severity.String(), d.code, d.message, d.input, d.line, d.output})
+}
+
+// asDiagnostics splits an error into diagnostics, errors which are not
+// diagnostics already get no code.
+func asDiagnostics(err error) []diagnostic {
+	switch e := err.(type) {
+	case diagnostic:
+		return []diagnostic{e}
+	case errorList:
+		var diags []diagnostic
+		for _, err := range e {
+			diags = append(diags, asDiagnostics(err)...)
+		}
+		return diags
+	default:
+		return []diagnostic{{severity: severityError, message: err.Error()}}
+	}
+}
+
+type logFormat int8
+
+const (
+	logText logFormat = iota
+	logJSON
+)
+
+func (f logFormat) String() string {
+	if f == logJSON {
+		return "json"
+	}
+	return "text"
+}
+
+func parseLogFormat(format string) (logFormat, error) {
+	switch strings.ToLower(format) {
+	case "text", "":
+		return logText, nil
+	case "json":
+		return logJSON, nil
+	default:
+		return logText, fmt.Errorf("invalid log format '%s'", format)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type textEncoding int8
+
+const (
+	encodingUnknown textEncoding = iota
+	encodingUTF8
+	encodingUTF8BOM
+	encodingUTF16LE
+	encodingUTF16BE
+	encodingLatin1
+	// Binary encodings, the content of the block is decoded
+	encodingBase64
+	encodingHex
+)
+
+func (enc textEncoding) String() string {
+	switch enc {
+	case encodingUTF8:
+		return "utf-8"
+	case encodingUTF8BOM:
+		return "utf-8-bom"
+	case encodingUTF16LE:
+		return "utf-16le"
+	case encodingUTF16BE:
+		return "utf-16be"
+	case encodingLatin1:
+		return "latin1"
+	case encodingBase64:
+		return "base64"
+	case encodingHex:
+		return "hex"
+	default:
+		return "unknown"
+	}
+}
+
+func parseTextEncoding(enc string) textEncoding {
+	switch strings.ToLower(enc) {
+	case "utf-8", "utf8":
+		return encodingUTF8
+	case "utf-8-bom", "utf8-bom":
+		return encodingUTF8BOM
+	case "utf-16le", "utf16le":
+		return encodingUTF16LE
+	case "utf-16be", "utf16be":
+		return encodingUTF16BE
+	case "latin1", "latin-1", "iso-8859-1":
+		return encodingLatin1
+	case "base64":
+		return encodingBase64
+	case "hex":
+		return encodingHex
+	default:
+		return encodingUnknown
+	}
+}
+
+// encodingError reports a character of the UTF-8 input, which can't be
+// represented in the desired encoding.
+type encodingError struct {
+	encoding textEncoding
+	line     int
+	char     rune
+}
+
+func (e *encodingError) Error() string {
+	if e.char == utf8.RuneError {
+		return fmt.Sprintf("line %d: invalid UTF-8", e.line)
+	}
+	return fmt.Sprintf("line %d: character %q can't be represented in %s", e.line, e.char, e.encoding)
+}
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+func (enc textEncoding) isBinary() bool {
+	return enc == encodingBase64 || enc == encodingHex
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// decode decodes the lines of a block using a binary encoding, whitespace
+// is ignored. On errors, the index of the offending line is returned.
+func (enc textEncoding) decode(lines [][]byte) ([]byte, int, error) {
+	var data []byte
+	var lineOf []int
+	for i, line := range lines {
+		for _, c := range line {
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+				continue
+			}
+			data = append(data, c)
+			lineOf = append(lineOf, i)
+		}
+	}
+	lineAt := func(offset int) int {
+		switch {
+		case offset < len(lineOf):
+			return lineOf[offset]
+		case len(lineOf) > 0:
+			return lineOf[len(lineOf)-1]
+		default:
+			return 0
+		}
+	}
+
+	switch enc {
+	case encodingBase64:
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(out, data)
+		if corrupt, ok := err.(base64.CorruptInputError); ok {
+			return nil, lineAt(int(corrupt)), fmt.Errorf("invalid base64 data")
+		} else if err != nil {
+			return nil, lineAt(len(data)), err
+		}
+		return out[:n], 0, nil
+	case encodingHex:
+		for i, c := range data {
+			if !isHexDigit(c) {
+				return nil, lineAt(i), fmt.Errorf("invalid hex character %q", c)
+			}
+		}
+		if len(data)%2 != 0 {
+			return nil, lineAt(len(data)), fmt.Errorf("odd number of hex digits")
+		}
+		out := make([]byte, hex.DecodedLen(len(data)))
+		_, err := hex.Decode(out, data)
+		return out, 0, err
+	default:
+		return nil, 0, fmt.Errorf("%s is not a binary encoding", enc)
+	}
+}
+
+// encode transcodes UTF-8 content to the given encoding. The UTF-16
+// encodings are written with a byte order mark, as most Windows tools
+// rely on it to detect them.
+func (enc textEncoding) encode(content []byte) ([]byte, error) {
+	if enc.isUTF8() {
+		return content, nil
+	}
+
+	var out bytes.Buffer
+	out.Write(enc.byteOrderMark())
+	if _, err := enc.encodeText(&out, content, 1); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// isUTF8 is true if content is written as is, without any transcoding
+func (enc textEncoding) isUTF8() bool {
+	return enc == encodingUnknown || enc == encodingUTF8 || enc.isBinary()
+}
+
+func (enc textEncoding) byteOrderMark() []byte {
+	switch enc {
+	case encodingUTF8BOM:
+		return utf8BOM
+	case encodingUTF16LE:
+		return []byte{0xff, 0xfe}
+	case encodingUTF16BE:
+		return []byte{0xfe, 0xff}
+	default:
+		return nil
+	}
+}
+
+// encodeText transcodes a part of the content without byte order mark. line
+// is the number of its first line, the number of the line following it is
+// returned.
+func (enc textEncoding) encodeText(out *bytes.Buffer, content []byte, line int) (int, error) {
+	for i := 0; i < len(content); {
+		r, size := utf8.DecodeRune(content[i:])
+		if r == utf8.RuneError && size <= 1 {
+			return line, &encodingError{enc, line, r}
+		}
+		i += size
+		if r == '\n' || (r == '\r' && (i == len(content) || content[i] != '\n')) {
+			line++
+		}
+
+		switch enc {
+		case encodingUTF8BOM:
+			out.WriteRune(r)
+		case encodingUTF16LE, encodingUTF16BE:
+			units := []uint16{uint16(r)}
+			if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+				units = []uint16{uint16(r1), uint16(r2)}
+			}
+			for _, u := range units {
+				if enc == encodingUTF16LE {
+					out.Write([]byte{byte(u), byte(u >> 8)})
+				} else {
+					out.Write([]byte{byte(u >> 8), byte(u)})
+				}
+			}
+		case encodingLatin1:
+			if r > 0xff {
+				return line, &encodingError{enc, line, r}
+			}
+			out.WriteByte(byte(r))
+		}
+	}
+	return line, nil
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 
 	"gotest.tools/assert"
@@ -13,19 +14,19 @@ import (
 func TestRenderSimple(t *testing.T) {
 	input := readExampleFile("simple.md")
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 1)
 
 	sh := "#!/usr/bin/env bash\necho \"Hello, World\"\n"
-	assertOutput(t, output["hello.sh"], sh)
+	assertOutput(t, output.get("hello.sh").content, sh)
 }
 
 func TestRenderMultipleFiles(t *testing.T) {
 	input := readExampleFile("multiple-files.md")
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 2)
@@ -33,95 +34,292 @@ func TestRenderMultipleFiles(t *testing.T) {
 	dataJSON := "{\r\n    \"foo\": \"bar\",\r\n    \"hello\": \"world\"\r\n}\r\n"
 	showSh := "#!/bin/bash\ncat data.json | jq .\n"
 
-	assertOutput(t, output["data.json"], dataJSON)
-	assertOutput(t, output["show.sh"], showSh)
+	assertOutput(t, output.get("data.json").content, dataJSON)
+	assertOutput(t, output.get("show.sh").content, showSh)
 }
 
 func TestRenderSplitFile(t *testing.T) {
 	input := readExampleFile("split-file.md")
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 1)
 
 	ps1 := "\"Hello World\"\r\ngci env:* | sort-object name\r\n"
 
-	assertOutput(t, output["splitted.ps1"], ps1)
+	assertOutput(t, output.get("splitted.ps1").content, ps1)
 }
 
 func TestRenderInvalid(t *testing.T) {
 	input := readExampleFile("invalid.md")
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
 	t.Log(output)
 
-	if isWindows {
-		assert.Assert(t, err == nil)
-		assert.Assert(t, len(output) == 0)
-	} else {
-		// Unix filenames are crazy...
-		assert.Assert(t, err == nil)
-		assert.Assert(t, len(output) == 3)
-
-		assert.Assert(t, output[`..\..\something.txt`] != nil)
-		assert.Assert(t, output[`C:\temp\evil.bat`] != nil)
-		assert.Assert(t, output["C:/temp/evil.bat"] != nil)
-	}
+	// The same paths are rejected on every platform
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 0)
 }
 
 func TestRenderWindowsSeparator(t *testing.T) {
 	input := readExampleFile("windows-separators.md")
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
+	// \ is a separator on every platform
 	assert.Assert(t, err == nil)
-	if isWindows {
-		assert.Assert(t, len(output) == 1)
-		helloBat := "@echo off\r\necho Hello,\r\necho Same File\r\n"
-		assertOutput(t, output["example/hello.bat"], helloBat)
-	} else {
-		assert.Assert(t, len(output) == 2)
-		helloBat := "@echo off\r\necho Hello,\r\n"
-		assertOutput(t, output["example/hello.bat"], helloBat)
-		helloBat2 := "echo Same File\r\n"
-		assertOutput(t, output[`example\hello.bat`], helloBat2)
-	}
+	assert.Assert(t, len(output) == 1)
+	helloBat := "@echo off\r\necho Hello,\r\necho Same File\r\n"
+	assertOutput(t, output.get("example/hello.bat").content, helloBat)
 }
 
 func TestRenderLineEndings(t *testing.T) {
 	input := readExampleFile("lineendings.md")
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 4)
 
 	unixSh := "#!/usr/bin/env bash\necho \"Using LF on linux\"\n"
-	assertOutput(t, output["unix.sh"], unixSh)
+	assertOutput(t, output.get("unix.sh").content, unixSh)
 
 	windowsBat := "@echo off\r\necho For windows\r\necho Use CRLF\r\n"
-	assertOutput(t, output["windows.bat"], windowsBat)
+	assertOutput(t, output.get("windows.bat").content, windowsBat)
 
 	splittedSh := "#!/usr/bin/env bash\necho \"This file, will use LF.\"\necho \"Because LF was specified first.\"\necho \"It's not important to keep all FILE-pragmas in sync.\"\n"
-	assertOutput(t, output["splitted.sh"], splittedSh)
+	assertOutput(t, output.get("splitted.sh").content, splittedSh)
 
 	exampleTxt := "This file uses \\r\ras line ending.\r"
-	assertOutput(t, output["example.txt"], exampleTxt)
+	assertOutput(t, output.get("example.txt").content, exampleTxt)
+}
+
+func TestRenderInfoAttributes(t *testing.T) {
+	input := readExampleFile("attributes.md")
+
+	output, err := render(input, renderOptions{})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 2)
+
+	setupSh := "#!/usr/bin/env bash\necho \"Setting things up\"\n### FILE: other.sh\necho \"Still in setup.sh\"\n"
+	assertOutput(t, output.get("setup.sh").content, setupSh)
+	assert.Assert(t, output.get("setup.sh").attrs.mode == 0700)
+
+	installBat := "@echo off\r\necho Step 1\r\necho Step 2\r\n"
+	assertOutput(t, output.get("install steps.bat").content, installBat)
+	assert.Assert(t, output.get("install steps.bat").attrs.mode == 0)
+}
+
+func TestRenderCommentPragmas(t *testing.T) {
+	input := readExampleFile("comments.md")
+
+	output, err := render(input, renderOptions{})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 4)
+
+	assertOutput(t, output.get("config.json").content, "{\n    \"answer\": 42\n}\n")
+	assertOutput(t, output.get("schema.sql").content, "CREATE TABLE foo (id INTEGER);\nCREATE TABLE bar (id INTEGER);\n")
+	assertOutput(t, output.get("run.bat").content, "@echo off\r\n")
+	assertOutput(t, output.get("index.html").content, "<p>Hello</p>\n")
+}
+
+func TestRenderHiddenPragma(t *testing.T) {
+	input := readExampleFile("hidden-pragma.md")
+
+	output, err := render(input, renderOptions{})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 2)
+
+	helloSh := "#!/usr/bin/env bash\necho \"Hello from a hidden pragma\"\n"
+	assertOutput(t, output.get("hello.sh").content, helloSh)
+	assert.Assert(t, output.get("hello.sh").attrs.mode == 0755)
+
+	assertOutput(t, output.get("hello.bat").content, "@echo off\r\necho Hello\r\n")
+}
+
+func TestRenderNested(t *testing.T) {
+	input := readExampleFile("nested.md")
+
+	output, err := render(input, renderOptions{})
+
+	assert.Assert(t, err == nil)
+
+	files := []string{
+		"top.sh",
+		"indented.sh",
+		"list.sh",
+		"list-indented.sh",
+		"nested-list.sh",
+		"quote.sh",
+		"quote-indented.sh",
+		"quote-list.sh",
+		"dedent.sh",
+	}
+	assert.Assert(t, len(output) == len(files))
+
+	sh := "if true; then\n    echo \"nested\"\nfi\n"
+	for _, file := range files {
+		t.Log(file)
+		assertOutput(t, output.get(file).content, sh)
+	}
+}
+
+func TestRenderEncoding(t *testing.T) {
+	input := readExampleFile("encoding.md")
+
+	output, err := render(input, renderOptions{})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 3)
+
+	greetPs1 := "\xff\xfe\"\x00G\x00r\x00\xfc\x00\xdf\x00e\x00\"\x00\r\x00\n\x00"
+	assertOutput(t, output.get("greet.ps1").content, greetPs1)
+
+	greetBat := "@echo off\r\necho Gr\xfc\xdfe\r\n"
+	assertOutput(t, output.get("greet.bat").content, greetBat)
+
+	greetSh := "\xef\xbb\xbfecho \"Grüße\"\necho \"¡Hola!\"\n"
+	assertOutput(t, output.get("greet.sh").content, greetSh)
+}
+
+func TestRenderWhitespace(t *testing.T) {
+	input := readExampleFile("whitespace.md")
+
+	output, err := render(input, renderOptions{})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 2)
+
+	assertOutput(t, output.get("tidy.sh").content, "if true; then\n    echo \"tidy\"\nfi\n")
+	assertOutput(t, output.get("Makefile").content, "all:\n\techo \"tabs\"  \n")
+
+	// Global options apply to all files, unless overridden
+	opts := renderOptions{whitespace: whitespaceOptions{trimTrailing: true, expandTabs: 2}}
+	output, err = render(input, opts)
+
+	assert.Assert(t, err == nil)
+	assertOutput(t, output.get("tidy.sh").content, "if true; then\n    echo \"tidy\"\nfi\n")
+	assertOutput(t, output.get("Makefile").content, "all:\n\techo \"tabs\"  \n")
+}
+
+func TestRenderConflictPolicy(t *testing.T) {
+	input := readExampleFile("lineendings.md")
+
+	// first-wins is the default, see TestRenderLineEndings
+	output, err := render(input, renderOptions{conflicts: conflictLastWins})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 4)
+
+	splittedSh := "#!/usr/bin/env bash\r\necho \"This file, will use LF.\"\r\necho \"Because LF was specified first.\"\r\necho \"It's not important to keep all FILE-pragmas in sync.\"\r\n"
+	assertOutput(t, output.get("splitted.sh").content, splittedSh)
+
+	_, err = render(input, renderOptions{conflicts: conflictError})
+	assert.Error(t, err, "splitted.sh (line 35, input 1): eol=crlf conflicts with eol=lf")
+
+	// Conflicts across multiple inputs
+	input = append(input, []byte("```sh {file=unix.sh eol=crlf mode=0700}\n```\n"))
+	_, err = render(input, renderOptions{conflicts: conflictError})
+	assert.Error(t, err, "splitted.sh (line 35, input 1): eol=crlf conflicts with eol=lf\n"+
+		"unix.sh (line 1, input 2): eol=crlf conflicts with eol=lf")
+}
+
+func TestRenderCollisions(t *testing.T) {
+	input := readExampleFile("collisions.md")
+
+	_, err := render(input, renderOptions{})
+
+	assert.Error(t, err, "output paths collide on case-insensitive file systems: Setup.ps1, setup.ps1\n"+
+		"output paths collide on case-insensitive file systems: cafe\u0301.txt, caf\u00e9.txt")
+
+	output, err := render(input, renderOptions{warnCollisions: true})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 4)
+}
+
+func TestRenderLayout(t *testing.T) {
+	input := readExampleFile("layout.md")
+
+	output, err := render(input, renderOptions{})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 7)
+
+	assert.Assert(t, output.get("logs").attrs.kind == outputDir)
+	assert.Assert(t, output.get("logs").attrs.mode == 0750)
+	assert.Assert(t, output.get("releases/v1").attrs.kind == outputDir)
+	assert.Assert(t, output.get("cache").attrs.kind == outputDir)
+	assert.Assert(t, output.get("cache").attrs.mode == 0700)
+
+	assert.Assert(t, output.get("current").attrs.kind == outputLink)
+	assert.Assert(t, output.get("current").attrs.target == "releases/v2")
+	assert.Assert(t, output.get("releases/latest").attrs.target == "v2")
+	assert.Assert(t, output.get("run.sh").attrs.target == "current/run.sh")
+
+	assert.Assert(t, output.get("releases/v2/run.sh").attrs.kind == outputFile)
+	assertOutput(t, output.get("releases/v2/run.sh").content, "echo \"Version 2\"\n")
+
+	// The same path can't be used for different kinds
+	input = append(input, []byte("```\n### FILE: logs\n```\n"))
+	_, err = render(input, renderOptions{})
+	assert.Error(t, err, "logs (line 2, input 2): declared as file, but already declared as directory")
+}
+
+func TestRenderBinary(t *testing.T) {
+	input := readExampleFile("binary.md")
+
+	output, err := render(input, renderOptions{whitespace: whitespaceOptions{finalNewline: true}})
+
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 3)
+
+	assertOutput(t, output.get("assets/header.png").content, "\x89PNG\r\n\x1a\n")
+	assertOutput(t, output.get("assets/answer.der").content, "\x30\x03\x02\x01\x2a")
+	assertOutput(t, output.get("assets/split.bin").content, "\xca\xfe\xba\xbe")
+}
+
+func TestRenderBinaryInvalid(t *testing.T) {
+	input := "# Invalid\n\n```{file=a.bin encoding=base64}\nAAAA\nAA!A\n```\n\n" +
+		"```{file=b.bin encoding=hex}\n00 11\n22 3\n```\n\n" +
+		"```{file=c.bin encoding=hex}\n00\n```\n\n" +
+		"```\n### FILE: c.bin\n\n0g\n```\n"
+
+	_, err := render([][]byte{[]byte(input)}, renderOptions{})
+
+	assert.Error(t, err, "a.bin (line 5, input 1): invalid base64 data\n"+
+		"b.bin (line 10, input 1): odd number of hex digits\n"+
+		"c.bin (line 20, input 1): invalid hex character 'g'")
+
+	// Binary and text blocks can't be mixed in one file
+	input = "```sh {file=a.bin}\necho a\n```\n\n```{file=a.bin encoding=base64}\nAAEC\n```\n\n" +
+		"```{file=b.bin encoding=hex}\n00\n```\n\n```sh {file=b.bin encoding=utf-8}\necho b\n```\n"
+
+	dir := getTempDir(t)
+	for _, stream := range []bool{false, true} {
+		_, err = render([][]byte{[]byte(input)}, renderOptions{stream: stream, streamDir: dir})
+
+		assert.Error(t, err, "a.bin (line 6, input 1): encoding=base64 is binary, but previous blocks are text\n"+
+			"b.bin (line 14, input 1): encoding=utf-8 is text, but previous blocks are binary")
+	}
 }
 
 func TestRenderMultipleInputFilesSingleOutput(t *testing.T) {
 	input := readExampleFile("simple.md")
 	input = append(input, readExampleFile("multiple-inputs.md")...)
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 1)
 
 	sh := "#!/usr/bin/env bash\necho \"Hello, World\"\necho \"Hello from second file\"\n"
-	assertOutput(t, output["hello.sh"], sh)
+	assertOutput(t, output.get("hello.sh").content, sh)
 }
 
 func TestRenderMultipleInputOutput(t *testing.T) {
@@ -130,7 +328,7 @@ func TestRenderMultipleInputOutput(t *testing.T) {
 	input = append(input, readExampleFile("simple.md")...)
 	input = append(input, readExampleFile("multiple-inputs.md")...)
 
-	output, err := render(input)
+	output, err := render(input, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 7)
@@ -138,21 +336,58 @@ func TestRenderMultipleInputOutput(t *testing.T) {
 	dataJSON := "{\r\n    \"foo\": \"bar\",\r\n    \"hello\": \"world\"\r\n}\r\n"
 	showSh := "#!/bin/bash\ncat data.json | jq .\n"
 
-	assertOutput(t, output["data.json"], dataJSON)
-	assertOutput(t, output["show.sh"], showSh)
+	assertOutput(t, output.get("data.json").content, dataJSON)
+	assertOutput(t, output.get("show.sh").content, showSh)
 
 	unixSh := "#!/usr/bin/env bash\necho \"Using LF on linux\"\n"
-	assertOutput(t, output["unix.sh"], unixSh)
+	assertOutput(t, output.get("unix.sh").content, unixSh)
 
 	windowsBat := "@echo off\r\necho For windows\r\necho Use CRLF\r\n"
-	assertOutput(t, output["windows.bat"], windowsBat)
+	assertOutput(t, output.get("windows.bat").content, windowsBat)
 
 	splittedSh := "#!/usr/bin/env bash\necho \"This file, will use LF.\"\necho \"Because LF was specified first.\"\necho \"It's not important to keep all FILE-pragmas in sync.\"\n"
-	assertOutput(t, output["splitted.sh"], splittedSh)
+	assertOutput(t, output.get("splitted.sh").content, splittedSh)
 
 	exampleTxt := "This file uses \\r\ras line ending.\r"
-	assertOutput(t, output["example.txt"], exampleTxt)
+	assertOutput(t, output.get("example.txt").content, exampleTxt)
 
 	sh := "#!/usr/bin/env bash\necho \"Hello, World\"\necho \"Hello from second file\"\n"
-	assertOutput(t, output["hello.sh"], sh)
+	assertOutput(t, output.get("hello.sh").content, sh)
+}
+
+func TestLint(t *testing.T) {
+	input := readExampleFile("lint.md")
+
+	var problems []string
+	for _, d := range lint("lint.md", input[0]) {
+		problems = append(problems, fmt.Sprintf("%d %s", d.line, d.code))
+	}
+
+	assert.DeepEqual(t, problems, []string{
+		"8 pragma-near-miss",
+		"15 pragma-near-miss",
+		"22 pragma-near-miss",
+		"30 misplaced-pragma",
+		"37 empty-block",
+		"43 missing-pragma",
+	})
+}
+
+func TestRenderValidation(t *testing.T) {
+	input := readExampleFile("validation.md")
+
+	output, err := render(input, renderOptions{})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 5)
+
+	_, err = render(input, renderOptions{validate: true})
+	assert.Error(t, err, `Cargo.toml (line 32, input 1): invalid TOML: expected value but found '\n' instead`+"\n"+
+		`config.json (line 16, input 1): invalid JSON: invalid character '"' after object key:value pair`+"\n"+
+		"pom.xml (line 38, input 1): invalid XML: element <project> closed by </projekt>\n"+
+		"settings.yml (line 24, input 1): invalid YAML: mapping values are not allowed in this context")
+
+	// Removed blank lines are taken into account
+	input = [][]byte{[]byte("```\n### FILE: a.json\n\n\n{\n  \"a\": 1,\n}\n```\n")}
+	_, err = render(input, renderOptions{validate: true, whitespace: whitespaceOptions{stripLeadingBlank: true}})
+	assert.Error(t, err, "a.json (line 7, input 1): invalid JSON: invalid character '}' looking for beginning of object key string")
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// commandLine is given either as a list of arguments, or as a string which
+// is split at whitespace.
+type commandLine []string
+
+func (c *commandLine) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = strings.Fields(value.Value)
+		return nil
+	}
+	var args []string
+	if err := value.Decode(&args); err != nil {
+		return err
+	}
+	*c = args
+	return nil
+}
+
+func subexpIndex(re *regexp.Regexp, name string) int {
+	for i, n := range re.SubexpNames() {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Diagnostics in the format of gcc, e.g. "-:3:5: warning: message"
+const defaultDiagnosticPattern = `^[^:]*:(?P<line>\d+):(?:\d+:)?\s*(?:(?P<severity>error|warning|note|info|style):\s*)?(?P<message>.*)$`
+
+// externalValidator runs a command on every output matching a pattern, e.g.
+// shellcheck on shell scripts. The content is passed on stdin, and every
+// line of the output matching the pattern is reported as a diagnostic.
+type externalValidator struct {
+	Files   string      `yaml:"files"`
+	Command commandLine `yaml:"command"`
+	Pattern string      `yaml:"pattern"`
+
+	// Directory the command is run in
+	dir     string
+	pattern *regexp.Regexp
+}
+
+func (v *externalValidator) init(dir string) error {
+	if v.Files == "" {
+		return fmt.Errorf("validator without files")
+	}
+	if _, err := path.Match(v.Files, ""); err != nil {
+		return fmt.Errorf("validator for %s: invalid pattern", v.Files)
+	}
+	if len(v.Command) == 0 {
+		return fmt.Errorf("validator for %s: no command", v.Files)
+	}
+
+	pattern := v.Pattern
+	if pattern == "" {
+		pattern = defaultDiagnosticPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("validator for %s: %v", v.Files, err)
+	}
+	if subexpIndex(re, "line") < 0 || subexpIndex(re, "message") < 0 {
+		return fmt.Errorf("validator for %s: pattern needs the groups line and message", v.Files)
+	}
+	v.dir = dir
+	v.pattern = re
+	return nil
+}
+
+// matches checks the path of an output against the files pattern. Patterns
+// without a slash match the file name in any directory.
+func (v *externalValidator) matches(p string) bool {
+	if !strings.Contains(v.Files, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(v.Files, p)
+	return ok
+}
+
+func (v *externalValidator) diagnostic(sc script, sev severity, line int, format string, a ...interface{}) diagnostic {
+	d := newDiagnostic(sev, codeExternalValidator, "%s: %s", v.Command[0], fmt.Sprintf(format, a...))
+	d.output = sc.path
+	if line > 0 {
+		d.input, d.line = sc.locate(line)
+		if d.input == "" {
+			d.message = fmt.Sprintf("line %d: %s", line, d.message)
+		}
+	}
+	return d
+}
+
+// run validates an output, lines reported as error by the command are
+// errors, everything else is a warning.
+func (v *externalValidator) run(sc script) []diagnostic {
+	log.verbose3f("Validating %s with %s\n", sc.path, strings.Join(v.Command, " "))
+
+	cmd := exec.Command(v.Command[0], v.Command[1:]...)
+	cmd.Dir = v.dir
+	cmd.Stdin = bytes.NewReader(sc.content)
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return []diagnostic{v.diagnostic(sc, severityError, 0, "%v", err)}
+	}
+
+	var diags []diagnostic
+	for _, text := range strings.Split(string(out), "\n") {
+		match := v.pattern.FindStringSubmatch(strings.TrimRight(text, "\r"))
+		if match == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(match[subexpIndex(v.pattern, "line")])
+		sev := severityWarning
+		if i := subexpIndex(v.pattern, "severity"); i >= 0 && strings.EqualFold(match[i], "error") {
+			sev = severityError
+		}
+		diags = append(diags, v.diagnostic(sc, sev, line, "%s", match[subexpIndex(v.pattern, "message")]))
+	}
+
+	if err != nil && len(diags) == 0 {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		diags = append(diags, v.diagnostic(sc, severityError, 0, "%s", msg))
+	}
+	return diags
+}
@@ -1,10 +1,13 @@
 module github.com/lichtzeichner/markli
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/spf13/pflag v1.0.5
 	github.com/yuin/goldmark v1.1.14
+	golang.org/x/text v0.3.7
+	gopkg.in/yaml.v3 v3.0.1
 	gotest.tools v2.2.0+incompatible
 )
 
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontMatter are the keys of the YAML front matter of a document used by
+// markli, all others are ignored.
+type frontMatter struct {
+	Dir string `yaml:"markli-dir"`
+}
+
+// parseFrontMatter returns the output directory given in the front matter
+// of a document, which starts and ends with a line "---".
+func parseFrontMatter(input []byte) (string, []diagnostic) {
+	line, rest := nextLine(input)
+	if string(bytes.TrimSpace(line)) != "---" {
+		return "", nil
+	}
+	start := len(input) - len(rest)
+	for len(rest) > 0 {
+		end := len(input) - len(rest)
+		line, rest = nextLine(rest)
+		if marker := string(bytes.TrimSpace(line)); marker != "---" && marker != "..." {
+			continue
+		}
+
+		var fm frontMatter
+		content := input[start:end]
+		if err := yaml.Unmarshal(content, &fm); err != nil {
+			// Documents may start with a thematic break instead of front matter
+			if !bytes.Contains(content, []byte("markli-dir")) {
+				return "", nil
+			}
+			d := newDiagnostic(severityWarning, codeInvalidAttribute, "invalid front matter, ignoring it: %v", err)
+			d.line = 1
+			return "", []diagnostic{d}
+		}
+		return normalizePath(fm.Dir), nil
+	}
+	return "", nil
+}
+
+// nextLine splits the first line including its line ending from input
+func nextLine(input []byte) ([]byte, []byte) {
+	if i := bytes.IndexByte(input, '\n'); i >= 0 {
+		return input[:i+1], input[i+1:]
+	}
+	return input, nil
+}
+
+// setInputDir sets the directory for the outputs of an input, given in its
+// front matter or else its file name without extension.
+func (a *assembler) setInputDir(name string, dir string) {
+	a.dir = ""
+	if dir == "" {
+		dir = path.Base(normalizePath(name))
+		if ext := path.Ext(dir); ext != dir {
+			dir = strings.TrimSuffix(dir, ext)
+		}
+	}
+	err := validatePath(dir)
+	if err == nil && dir == "." {
+		err = fmt.Errorf("use merge=true for outputs in the output directory itself")
+	}
+	if err != nil {
+		d := newDiagnostic(severityError, codeInvalidPath, "invalid output directory %s: %v", dir, err)
+		a.report(d)
+		return
+	}
+	if other, ok := a.dirs[dir]; ok {
+		d := newDiagnostic(severityError, codePathCollision,
+			"output directory %s is already used by %s, use markli-dir in the front matter to choose another one", dir, other)
+		a.report(d)
+		return
+	}
+	a.dirs[dir] = name
+	a.dir = dir
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+)
+
+// outputKind is the type of filesystem entry created for an output
+type outputKind int8
+
+const (
+	outputFile outputKind = iota
+	outputDir
+	outputLink
+)
+
+func (kind outputKind) String() string {
+	switch kind {
+	case outputDir:
+		return "directory"
+	case outputLink:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+var dirPragmaRE = regexp.MustCompile(`###\s*DIR:\s*(\S+)(.*?)\s*$`)
+var linkPragmaRE = regexp.MustCompile(`###\s*LINK:\s*(.+?)\s*->\s*(.+?)\s*$`)
+
+// parseLayoutPragma parses a DIR or LINK pragma:
+//
+//	### DIR: logs mode=0750
+//	### LINK: current -> releases/v2
+func parseLayoutPragma(input []byte) (blockAttributes, []diagnostic, bool) {
+	var attrs blockAttributes
+	var warnings []diagnostic
+	if match := dirPragmaRE.FindSubmatch(input); match != nil {
+		attrs.kind = outputDir
+		attrs.path = normalizePath(string(match[1]))
+		for _, kv := range parseAttributes(match[2]) {
+			if kv[0] != "mode" && kv[0] != "merge" {
+				warnings = append(warnings, newDiagnostic(severityWarning, codeInvalidAttribute,
+					"unknown attribute '%s' for DIR, ignoring it", kv[0]))
+				continue
+			}
+			if err := attrs.set(kv[0], kv[1]); err != nil {
+				warnings = append(warnings, invalidAttribute(err))
+			}
+		}
+		return attrs, warnings, true
+	}
+	if match := linkPragmaRE.FindSubmatch(input); match != nil {
+		attrs.kind = outputLink
+		attrs.path = normalizePath(string(match[1]))
+		attrs.target = normalizePath(string(match[2]))
+		return attrs, nil, true
+	}
+	return attrs, nil, false
+}
+
+// parseLayoutBlock returns all DIR and LINK pragmas of a code block, if
+// the first line is one. Other lines of such a block are ignored with a
+// warning.
+func parseLayoutBlock(source []byte, node ast.Node) ([]blockAttributes, []diagnostic) {
+	var entries []blockAttributes
+	var warnings []diagnostic
+	for i := 0; i < node.Lines().Len(); i++ {
+		line := node.Lines().At(i)
+		value := line.Value(source)
+		attrs, lineWarnings, ok := parseLayoutPragma(value)
+		if !ok && i == 0 {
+			return nil, nil
+		}
+		if !ok && !isBlank(value) {
+			lineWarnings = append(lineWarnings, newDiagnostic(severityWarning, codeIgnoredLine,
+				"ignoring line without DIR or LINK pragma: %s", strings.TrimSpace(string(value))))
+		}
+		for _, d := range lineWarnings {
+			d.line = lineNumber(source, node) + i
+			warnings = append(warnings, d)
+		}
+		if ok {
+			entries = append(entries, attrs)
+		}
+	}
+	return entries, warnings
+}
+
+// validateLinkTarget makes sure the target of a link is relative, and
+// stays within the output directory when resolved from the link.
+func validateLinkTarget(link, target string) error {
+	// .. is fine as long as it stays within the output directory
+	if err := validateRelative(target); err != nil {
+		return fmt.Errorf("link target: %v", err)
+	}
+	if err := validateElements(target); err != nil {
+		return fmt.Errorf("link target: %v", err)
+	}
+	resolved := path.Join(path.Dir(link), strings.Replace(target, `\`, "/", -1))
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("link target leads outside of the output directory")
+	}
+	return nil
+}
+
+func writeDir(root string, filename string, sc script) error {
+	dir := filepath.Clean(filepath.Join(root, filename))
+	log.verbosef("Creating directory: %s\n", dir)
+
+	if err := checkSymlinks(root, filename, outputDir); err != nil {
+		return err
+	}
+
+	mode := sc.attrs.mode
+	if mode == 0 {
+		mode = 0755
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+
+	// MkdirAll does not change the mode of existing directories,
+	// and the mode of new ones is subject to the umask
+	if sc.attrs.mode != 0 {
+		return os.Chmod(dir, sc.attrs.mode)
+	}
+	return nil
+}
+
+func writeLink(root string, filename string, sc script) error {
+	link := filepath.Clean(filepath.Join(root, filename))
+	log.verbosef("Creating symlink: %s -> %s\n", link, sc.attrs.target)
+
+	if err := checkSymlinks(root, filename, outputLink); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+
+	// The target was checked against the path of the link, but the
+	// directory containing it may be a symlink itself, e.g. d/e with d -> .
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return err
+	}
+	realDir, err := filepath.EvalSymlinks(filepath.Join(absRoot, filepath.Dir(filepath.FromSlash(filename))))
+	if err != nil {
+		return err
+	}
+	resolved := filepath.Join(realDir, filepath.FromSlash(sc.attrs.target))
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = real
+	}
+	if !isWithin(realRoot, resolved) {
+		return fmt.Errorf("link target of %s leads outside of the output directory", link)
+	}
+
+	if info, err := os.Lstat(link); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s exists and is not a symlink", link)
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(filepath.FromSlash(sc.attrs.target), link)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// Codes of the lint rules, in addition to the diagnostics of rendering
+const (
+	codeNearMiss        = "pragma-near-miss"
+	codeMisplacedPragma = "misplaced-pragma"
+	codeMissingPragma   = "missing-pragma"
+	codeEmptyBlock      = "empty-block"
+)
+
+// lintRules are all rules reported by markli lint, each can be disabled
+var lintRules = []string{
+	codeNearMiss,
+	codeMisplacedPragma,
+	codeMissingPragma,
+	codeEmptyBlock,
+	codeInvalidPath,
+	codeInvalidLink,
+	codeInvalidAttribute,
+	codeMissingFile,
+	codeOrphanPragma,
+	codeIgnoredLine,
+	codeKindConflict,
+	codeEncodingConflict,
+	codeAttributeConflict,
+	codeInvalidData,
+	codeInvalidSyntax,
+	codeUnencodable,
+	codePathCollision,
+}
+
+func isLintRule(code string) bool {
+	for _, rule := range lintRules {
+		if rule == code {
+			return true
+		}
+	}
+	return false
+}
+
+// nearMissRE matches lines which look like a pragma in a comment, e.g.
+// "##FILE: foo", "### FILE-CRFL: foo" or "### FILE foo".
+var nearMissRE = regexp.MustCompile(`^\s*(?:(?:#+|//+|--|;+|::|(?i:@?rem\s)|/\*|<!--|<#)\s*(?:FILE|DIR|LINK)\b|###\s*(?i:file|dir|link)\b)`)
+
+// fileNameRE matches words in an info string which look like a file name
+var fileNameRE = regexp.MustCompile(`^[^\s={}"']*(?:/[^\s={}"']+|\.[A-Za-z]\w*)$`)
+
+// infoFileName returns a word of the info string after the language, which
+// looks like the name of a file, e.g. "setup.sh" in "sh setup.sh".
+func infoFileName(info []byte) string {
+	words := strings.Fields(string(attributeListRE.ReplaceAll(info, nil)))
+	for i, word := range words {
+		if i == 0 {
+			continue
+		}
+		if eq := strings.IndexByte(word, '='); eq >= 0 {
+			word = word[eq+1:]
+		}
+		word = strings.Trim(word, `"'`)
+		if fileNameRE.MatchString(word) {
+			return word
+		}
+	}
+	return ""
+}
+
+// declaredAttributes returns the attributes of a code block given by a
+// markli comment or the info string, warnings are ignored as they are
+// reported by rendering.
+func declaredAttributes(source []byte, node ast.Node) (blockAttributes, bool) {
+	if prev := node.PreviousSibling(); prev != nil && prev.Kind() == ast.KindHTMLBlock {
+		if attrs, _, ok := parseHiddenPragma(htmlBlockContent(source, prev)); ok {
+			return attrs, true
+		}
+	}
+	if fenced, ok := node.(*ast.FencedCodeBlock); ok && fenced.Info != nil {
+		info := fenced.Info.Segment
+		if attrs, _ := parseInfoAttributes(info.Value(source)); attrs.path != "" {
+			return attrs, true
+		}
+	}
+	return blockAttributes{}, false
+}
+
+func lintCodeBlock(source []byte, node ast.Node) []diagnostic {
+	if layout, _ := parseLayoutBlock(source, node); layout != nil {
+		return nil
+	}
+
+	var diags []diagnostic
+	report := func(index int, d diagnostic) {
+		d.line = lineNumber(source, node) + index
+		diags = append(diags, d)
+	}
+
+	language := ""
+	var info []byte
+	if fenced, ok := node.(*ast.FencedCodeBlock); ok && fenced.Info != nil {
+		segment := fenced.Info.Segment
+		info = segment.Value(source)
+		language = string(fenced.Language(source))
+	}
+
+	lines := node.Lines()
+	attrs, declared := declaredAttributes(source, node)
+	start := 0
+	if !declared && lines.Len() > 0 {
+		first := lines.At(0)
+		value := first.Value(source)
+		if attrs.path, _ = parseLanguagePragma(value, language); attrs.path != "" {
+			declared = true
+			start = 1
+		} else if nearMissRE.Match(value) {
+			report(0, newDiagnostic(severityWarning, codeNearMiss,
+				"looks like a pragma, but is not recognized: %s", strings.TrimSpace(string(value))))
+		}
+	}
+
+	if declared && attrs.kind == outputFile {
+		empty := true
+		for i := start; i < lines.Len(); i++ {
+			line := lines.At(i)
+			if !isBlank(line.Value(source)) {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			d := newDiagnostic(severityWarning, codeEmptyBlock, "code block is empty")
+			d.output = attrs.path
+			report(0, d)
+		}
+	}
+	if name := infoFileName(info); !declared && name != "" {
+		report(0, newDiagnostic(severityWarning, codeMissingPragma,
+			"code block looks like the content of %s, but has no FILE pragma", name))
+	}
+
+	// Pragmas are only recognized on the first line, without attributes
+	first := 1
+	if declared {
+		first = start
+	}
+	for i := first; i < lines.Len(); i++ {
+		line := lines.At(i)
+		if p, _ := parseLanguagePragma(line.Value(source), language); p != "" {
+			report(i, newDiagnostic(severityWarning, codeMisplacedPragma,
+				"FILE pragma for %s within the content of a code block is ignored", p))
+		}
+	}
+	return diags
+}
+
+// lint checks a markdown input for likely mistakes, which are not found
+// by rendering it.
+func lint(name string, source []byte) []diagnostic {
+	md := goldmark.New(goldmark.WithExtensions(extension.GFM))
+	doc := md.Parser().Parse(text.NewReader(source))
+
+	var diags []diagnostic
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering && isCodeBlock(node) {
+			diags = append(diags, lintCodeBlock(source, node)...)
+		}
+		return ast.WalkContinue, nil
+	})
+	for i := range diags {
+		diags[i].input = name
+	}
+	return diags
+}
+
+// lintFiles reports all problems of the inputs, including those found
+// by rendering and validating them, with conflicting attributes as errors.
+func lintFiles(inputFiles []string) error {
+	inputs, err := readInputs(inputFiles)
+	if err != nil {
+		return err
+	}
+
+	for i, input := range inputs {
+		for _, d := range lint(inputFiles[i], input) {
+			log.diagnose(d)
+		}
+	}
+
+	opts := renderOptions{conflicts: conflictError, validate: true, inputNames: inputFiles}
+	if _, err := render(inputs, opts); err != nil {
+		log.report(err)
+	}
+	return nil
+}
+
+// parseDisabledRules returns the set of rules disabled on the command line
+func parseDisabledRules(rules []string) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	for _, rule := range rules {
+		if !isLintRule(rule) {
+			known := append([]string(nil), lintRules...)
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown rule '%s', known rules are: %s", rule, strings.Join(known, ", "))
+		}
+		disabled[rule] = true
+	}
+	return disabled, nil
+}
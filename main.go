@@ -1,31 +1,93 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	flag "github.com/spf13/pflag"
-
-	"github.com/yuin/goldmark"
-	"github.com/yuin/goldmark/extension"
-	"github.com/yuin/goldmark/parser"
 )
 
 type logger struct {
 	verbosity int
+	// Only print errors
+	quiet     bool
+	format    logFormat
 	outstream io.Writer
+	// Number of code blocks skipped so far
+	skipped int
+	// Codes of diagnostics which are not reported, and the number of
+	// errors and warnings reported so far
+	disabled map[string]bool
+	problems int
 }
 
 func (l *logger) printf(verbosity int, format string, a ...interface{}) {
-	if verbosity <= l.verbosity {
-		fmt.Fprintf(l.outstream, format, a...)
+	if l.quiet || verbosity > l.verbosity {
+		return
+	}
+	if l.format == logJSON {
+		l.writeJSON(diagnostic{
+			severity: severityInfo,
+			message:  strings.TrimSpace(fmt.Sprintf(format, a...)),
+		})
+		return
+	}
+	fmt.Fprintf(l.outstream, format, a...)
+}
+
+func (l *logger) writeJSON(d diagnostic) {
+	line, _ := json.Marshal(d)
+	fmt.Fprintf(l.outstream, "%s\n", line)
+}
+
+// diagnose prints a diagnostic. Errors are always shown, warnings unless
+// quiet, and informational messages only at verbosity 1 and above.
+func (l *logger) diagnose(d diagnostic) {
+	if l.disabled[d.code] {
+		return
+	}
+	if d.skipsBlock {
+		l.skipped++
+	}
+	if d.severity != severityInfo {
+		l.problems++
+	}
+	switch {
+	case d.severity == severityError:
+	case l.quiet:
+		return
+	case d.severity == severityInfo && l.verbosity < 1:
+		return
+	}
+
+	switch {
+	case l.format == logJSON:
+		l.writeJSON(d)
+	case d.severity == severityWarning:
+		fmt.Fprintf(l.outstream, "Warning: %v\n", d)
+	default:
+		fmt.Fprintf(l.outstream, "%v\n", d)
 	}
 }
 
+// report prints an error, each element of an errorList separately
+func (l *logger) report(err error) {
+	for _, d := range asDiagnostics(err) {
+		l.diagnose(d)
+	}
+}
+
+// infof prints a message shown unless quiet
+func (l *logger) infof(format string, a ...interface{}) {
+	l.printf(0, format, a...)
+}
+
 func (l *logger) verbosef(format string, a ...interface{}) {
 	l.printf(1, format, a...)
 }
@@ -38,92 +100,577 @@ func (l *logger) verbose3f(format string, a ...interface{}) {
 	l.printf(3, format, a...)
 }
 
+// errorList collects multiple errors, e.g. one for each offending file
+type errorList []error
+
+func (l errorList) Error() string {
+	msgs := make([]string, 0, len(l))
+	for _, err := range l {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
 var log *logger = &logger{
 	verbosity: 0,
 	outstream: os.Stderr,
 }
 
-func render(inputs [][]byte) (map[string][]byte, error) {
-	output := make(map[string]script)
-	blocks := newScriptBlocks(output)
-	retval := make(map[string][]byte)
-
-	md := goldmark.New(
-		goldmark.WithExtensions(extension.GFM),
-		goldmark.WithParserOptions(
-			parser.WithAutoHeadingID(),
-		),
-		goldmark.WithExtensions(
-			&blocks,
-		),
-	)
-
-	var buf bytes.Buffer
-	for _, input := range inputs {
-		err := md.Convert(input, &buf)
+type renderOptions struct {
+	whitespace whitespaceOptions
+	conflicts  conflictPolicy
+	// Only warn about paths colliding on case-insensitive file systems
+	warnCollisions bool
+	// Check the syntax of JSON, YAML, TOML and XML outputs
+	validate bool
+	// Commands run on matching outputs
+	validators []*externalValidator
+	// Names of the inputs used in diagnostics, by index
+	inputNames []string
+	// Blocks extracted from inputs before, nil if not cached
+	cache *renderCache
+	// Read and assemble the inputs one at a time, and write text outputs to
+	// temporary files in streamDir while doing so, instead of keeping their
+	// content. Nothing is streamed without streamDir.
+	stream    bool
+	streamDir string
+	// Write the outputs of every input to its own subdirectory
+	inputDirs bool
+}
+
+// validates is true if an output is checked by any validator, which needs
+// its whole content.
+func (o *renderOptions) validates(sc script) bool {
+	if _, ok := findSyntaxValidator(sc); ok && o.validate {
+		return true
+	}
+	for _, v := range o.validators {
+		if v.matches(sc.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// outputList contains all rendered outputs, sorted by path
+type outputList []script
+
+func (l outputList) find(path string) (script, bool) {
+	for _, sc := range l {
+		if sc.path == path {
+			return sc, true
+		}
+	}
+	return script{}, false
+}
+
+func (l outputList) has(path string) bool {
+	_, ok := l.find(path)
+	return ok
+}
+
+// inputName returns the name of an input used in diagnostics
+func (o *renderOptions) inputName(i int) string {
+	if i < len(o.inputNames) {
+		return o.inputNames[i]
+	}
+	return fmt.Sprintf("input %d", i+1)
+}
+
+func render(inputs [][]byte, opts renderOptions) (outputList, error) {
+	return renderInputs(len(inputs), func(i int) ([]byte, error) {
+		return inputs[i], nil
+	}, opts)
+}
+
+// renderInputs renders n inputs returned by read. Inputs are parsed
+// concurrently, but assembled in order. When streaming, every input is read,
+// parsed and assembled before the next one, so only one is kept in memory.
+func renderInputs(n int, read func(int) ([]byte, error), opts renderOptions) (outputList, error) {
+	asm := newAssembler(opts.conflicts)
+	asm.inputDirs = opts.inputDirs
+	if opts.stream {
+		asm.streamDir = opts.streamDir
+		asm.keep = opts.validates
+		ext := newExtractor()
+		for i := 0; i < n; i++ {
+			input, err := read(i)
+			if err != nil {
+				return nil, err
+			}
+			asm.addExtracted(opts.inputName(i), extractInput(ext, input, opts.cache))
+		}
+	} else {
+		inputs := make([][]byte, n)
+		for i := range inputs {
+			var err error
+			if inputs[i], err = read(i); err != nil {
+				return nil, err
+			}
+		}
+		for i, result := range extractAll(inputs, opts.cache) {
+			asm.addExtracted(opts.inputName(i), result)
+		}
+	}
+
+	output := make(outputList, 0, len(asm.output))
+	for path, sc := range asm.output {
+		sc.path = path
+		output = append(output, sc)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].path < output[j].path
+	})
+
+	// Outputs are checked even if assembling them failed, so all problems
+	// are reported at once
+	errs := append(errorList(nil), asm.errs...)
+	errs = append(errs, checkCollisions(output, opts.warnCollisions)...)
+
+	for i, sc := range output {
+		if sc.attrs.kind != outputFile || sc.attrs.encoding.isBinary() {
+			continue
+		}
+		whitespace := sc.attrs.whitespace.apply(opts.whitespace)
+		if sc.streamed {
+			// Streamed outputs are encoded to another temporary file, which
+			// is copied when writing them
+			sum, err := sc.spool.encode(whitespace, sc.attrs.lineEnding, sc.attrs.encoding)
+			if err != nil {
+				code := codeUnencodable
+				if _, ok := err.(*os.PathError); ok {
+					code = codeWriteFailed
+				}
+				d := newDiagnostic(severityError, code, "%v", err)
+				d.output = sc.path
+				errs = append(errs, d)
+				continue
+			}
+			output[i].sum = sum
+			continue
+		}
+		if whitespace.stripLeadingBlank {
+			sc.shiftOrigins(-leadingBlankLines(sc.content, sc.attrs.lineEnding.bytes()))
+		}
+		sc.content = whitespace.normalize(sc.content, sc.attrs.lineEnding.bytes())
+
+		if opts.validate {
+			if err := validateSyntax(sc); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		for _, v := range opts.validators {
+			if !v.matches(sc.path) {
+				continue
+			}
+			for _, d := range v.run(sc) {
+				if d.severity == severityError {
+					errs = append(errs, d)
+				} else {
+					log.diagnose(d)
+				}
+			}
+		}
+
+		content, err := sc.attrs.encoding.encode(sc.content)
 		if err != nil {
-			return retval, err
+			d := newDiagnostic(severityError, codeUnencodable, "%v", err)
+			d.output = sc.path
+			errs = append(errs, d)
+			continue
 		}
+		output[i].content = content
+	}
+	if len(errs) > 0 {
+		return output, errs
+	}
+
+	return output, nil
+}
+
+// checkCollisions reports all outputs colliding with others, the returned
+// errors are empty if warn is set.
+func checkCollisions(output outputList, warn bool) errorList {
+	paths := make([]string, 0, len(output))
+	for _, sc := range output {
+		paths = append(paths, sc.path)
 	}
 
-	for k, v := range output {
-		retval[k] = v.content
+	var errs errorList
+	for _, group := range findCollisions(paths) {
+		d := newDiagnostic(severityError, codePathCollision,
+			"output paths collide on case-insensitive file systems: %s", strings.Join(group, ", "))
+		if warn {
+			d.severity = severityWarning
+			log.diagnose(d)
+		} else {
+			errs = append(errs, d)
+		}
 	}
-	return retval, nil
+	return errs
 }
 
-func writeRendered(outDir string, output map[string][]byte) error {
-	for filename, content := range output {
-		path := filepath.Clean(filepath.Join(outDir, filename))
-		dir := filepath.Dir(path)
-		log.verbosef("Writing output: %s\n", path)
+// writeFile writes an output file below root, the returned bool is true if
+// the file already had the content and was kept.
+func writeFile(root string, filename string, sc script) (bool, error) {
+	path := filepath.Clean(filepath.Join(root, filename))
+	dir := filepath.Dir(path)
+	log.verbosef("Writing output: %s\n", path)
+
+	if err := checkSymlinks(root, filename, outputFile); err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+
+	mode := sc.attrs.mode
+	if mode == 0 {
+		mode = 0755
+	}
+
+	// Unchanged files are kept, so their modification time stays the same
+	unchanged := isUnchanged(path, sc)
+	if unchanged {
+		log.verbose2f("Output unchanged: %s\n", path)
+	} else if sc.streamed {
+		if err := writeStreamed(path, sc, mode); err != nil {
+			return false, err
+		}
+	} else if err := ioutil.WriteFile(path, sc.content, mode); err != nil {
+		return false, err
+	}
 
-		if err := os.MkdirAll(dir, 0755); err != nil {
+	// WriteFile does not change the mode of existing files
+	if sc.attrs.mode != 0 {
+		if err := os.Chmod(path, sc.attrs.mode); err != nil {
+			return unchanged, err
+		}
+	}
+	return unchanged, nil
+}
+
+// writeRendered writes all outputs below outDir. Outputs which can't be
+// written are skipped, all errors are returned at the end.
+func writeRendered(outDir string, output outputList) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	// Directories first and symlinks last, so files are written
+	// to the directories and not through symlinks
+	var errs errorList
+	for _, kind := range []outputKind{outputDir, outputFile, outputLink} {
+		for i, sc := range output {
+			if sc.attrs.kind != kind {
+				continue
+			}
+			var err error
+			switch kind {
+			case outputDir:
+				err = writeDir(outDir, sc.path, sc)
+			case outputLink:
+				err = writeLink(outDir, sc.path, sc)
+			default:
+				output[i].unchanged, err = writeFile(outDir, sc.path, sc)
+			}
+			if err != nil {
+				d := newDiagnostic(severityError, codeWriteFailed, "%v", err)
+				d.output = sc.path
+				errs = append(errs, d)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func readInputs(inputFiles []string) ([][]byte, error) {
+	inputs := make([][]byte, 0, len(inputFiles))
+
+	for _, file := range inputFiles {
+		log.verbose2f("Processing file %s\n", file)
+		input, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs, nil
+}
+
+// process renders all inputs to outDir, and writes a manifest of the
+// outputs if its name is given.
+func process(inputFiles []string, outDir string, opts renderOptions, manifest string) error {
+	if opts.stream {
+		dir, err := ioutil.TempDir("", "markli-")
+		if err != nil {
 			return err
 		}
+		defer os.RemoveAll(dir)
+		opts.streamDir = dir
+	}
 
-		if err := ioutil.WriteFile(path, content, 0755); err != nil {
+	skipped := log.skipped
+	opts.inputNames = inputFiles
+	rendered, err := renderInputs(len(inputFiles), func(i int) ([]byte, error) {
+		log.verbose2f("Processing file %s\n", inputFiles[i])
+		return ioutil.ReadFile(inputFiles[i])
+	}, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := writeRendered(outDir, rendered); err != nil {
+		return err
+	}
+
+	if manifest != "" {
+		if err := writeManifest(outDir, manifest, rendered); err != nil {
 			return err
 		}
 	}
+
+	files, unchanged := 0, 0
+	for _, sc := range rendered {
+		if sc.attrs.kind != outputFile {
+			continue
+		}
+		if sc.unchanged {
+			unchanged++
+		} else {
+			files++
+		}
+	}
+	summary := fmt.Sprintf("%s written to %s", plural(files, "file"), outDir)
+	if unchanged > 0 {
+		summary += fmt.Sprintf(", %d unchanged", unchanged)
+	}
+	log.infof("%s, %s skipped\n", summary, plural(log.skipped-skipped, "block"))
 	return nil
 }
 
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func buildTarget(cfg *config, t *target) error {
+	log.verbosef("Building target %s\n", t.Name)
+
+	if t.Options.Verbose > log.verbosity {
+		defer func(verbosity int) { log.verbosity = verbosity }(log.verbosity)
+		log.verbosity = t.Options.Verbose
+	}
+
+	inputFiles := make([]string, 0, len(t.Inputs))
+	for _, input := range t.Inputs {
+		inputFiles = append(inputFiles, cfg.resolve(input))
+	}
+	opts := t.Options.renderOptions()
+	opts.validators = cfg.Validators
+	if cfg.Cache != "" {
+		opts.cache = newRenderCache(cfg.resolve(cfg.Cache))
+	}
+	return process(inputFiles, cfg.resolve(t.OutDir), opts, t.Options.Manifest)
+}
+
+// setLogFormat configures the log format given on the command line
+func setLogFormat(format string) {
+	f, err := parseLogFormat(format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	log.format = f
+}
+
+func buildCommand(args []string) {
+	var configFile string
+	var logFormat string
+
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: markli build [flags] [target|tag]...\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVarP(&configFile, "config", "c", "", "Configuration file, defaults to markli.yaml in the working directory")
+	flags.CountVarP(&log.verbosity, "verbose", "v", "Control verbosity, shorthand can be given multiple times")
+	flags.BoolVarP(&log.quiet, "quiet", "q", false, "Only print errors")
+	flags.StringVar(&logFormat, "log-format", "text", "Format of log messages and diagnostics: text or json")
+	flags.Parse(args)
+	setLogFormat(logFormat)
+
+	if configFile == "" {
+		if configFile = findConfig("."); configFile == "" {
+			fmt.Fprint(os.Stderr, "No configuration file found\n")
+			os.Exit(1)
+		}
+	}
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		log.report(err)
+		os.Exit(1)
+	}
+
+	targets, err := cfg.selectTargets(flags.Args())
+	if err != nil {
+		log.report(err)
+		os.Exit(1)
+	}
+
+	for _, t := range targets {
+		if err := buildTarget(cfg, t); err != nil {
+			log.report(err)
+			os.Exit(1)
+		}
+	}
+}
+
+func verifyCommand(args []string) {
+	var manifest string
+	var logFormat string
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: markli verify [flags] [out-dir]\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVarP(&manifest, "manifest", "m", defaultManifestName, "Name of the manifest within the output directory")
+	flags.CountVarP(&log.verbosity, "verbose", "v", "Control verbosity, shorthand can be given multiple times")
+	flags.BoolVarP(&log.quiet, "quiet", "q", false, "Only print errors")
+	flags.StringVar(&logFormat, "log-format", "text", "Format of log messages and diagnostics: text or json")
+	flags.Parse(args)
+	setLogFormat(logFormat)
+
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	dir := "."
+	if flags.NArg() == 1 {
+		dir = flags.Arg(0)
+	}
+
+	if err := verifyManifest(dir, manifest); err != nil {
+		log.report(err)
+		os.Exit(1)
+	}
+}
+
+func lintCommand(args []string) {
+	var disabled []string
+	var logFormat string
+
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: markli lint [flags] file.md...\n")
+		flags.PrintDefaults()
+	}
+	flags.StringSliceVarP(&disabled, "disable", "d", nil, "Rules to disable, can be given multiple times or separated by commas")
+	flags.StringVar(&logFormat, "log-format", "text", "Format of log messages and diagnostics: text or json")
+	flags.Parse(args)
+	setLogFormat(logFormat)
+
+	if flags.NArg() == 0 {
+		fmt.Fprint(os.Stderr, "No inputs specified\n")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	rules, err := parseDisabledRules(disabled)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	log.disabled = rules
+
+	if err := lintFiles(flags.Args()); err != nil {
+		log.report(err)
+		os.Exit(1)
+	}
+	if log.problems > 0 {
+		os.Exit(1)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			buildCommand(os.Args[2:])
+			return
+		case "verify":
+			verifyCommand(os.Args[2:])
+			return
+		case "lint":
+			lintCommand(os.Args[2:])
+			return
+		}
+	}
+
 	var inputFiles []string
 	var outDir string
-	var rendered map[string][]byte
+	var opts renderOptions
+	var conflicts string
+	var manifest string
+	var logFormat string
+	var cacheDir string
 
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: markli [flags] -i file.md... [-o out-dir]\n"+
+			"       markli build [flags] [target|tag]...\n"+
+			"       markli verify [flags] [out-dir]\n"+
+			"       markli lint [flags] file.md...\n\n"+
+			"Run a command with --help for its flags.\n\n")
+		flag.PrintDefaults()
+	}
 	flag.StringArrayVarP(&inputFiles, "input", "i", []string{}, "Markdown file to process, can be given multiple times")
 	flag.StringVarP(&outDir, "out-dir", "o", ".", "Output directory.")
 	flag.CountVarP(&log.verbosity, "verbose", "v", "Control verbosity, shorthand can be given multiple times")
+	flag.BoolVarP(&log.quiet, "quiet", "q", false, "Only print errors")
+	flag.BoolVar(&opts.whitespace.finalNewline, "final-newline", false, "Ensure all outputs end with exactly one line ending")
+	flag.BoolVar(&opts.whitespace.trimTrailing, "trim-trailing", false, "Remove trailing whitespace from all lines")
+	flag.BoolVar(&opts.whitespace.stripLeadingBlank, "strip-leading-blank", false, "Remove blank lines at the start of outputs")
+	flag.IntVar(&opts.whitespace.expandTabs, "expand-tabs", 0, "Replace tabs by spaces, using the given tab width")
+	flag.IntVar(&opts.whitespace.unexpandTabs, "unexpand-tabs", 0, "Replace leading spaces by tabs, using the given tab width")
+	flag.StringVar(&conflicts, "conflicts", "first-wins", "Handling of conflicting attributes of split files: error, first-wins or last-wins")
+	flag.BoolVar(&opts.warnCollisions, "warn-collisions", false, "Only warn about output paths colliding on case-insensitive file systems")
+	flag.BoolVar(&opts.validate, "validate", false, "Check the syntax of JSON, YAML, TOML and XML outputs")
+	flag.StringVar(&manifest, "manifest", "", "Write a manifest with the SHA-256 checksums of all outputs to the output directory")
+	flag.Lookup("manifest").NoOptDefVal = defaultManifestName
+	flag.StringVar(&logFormat, "log-format", "text", "Format of log messages and diagnostics: text or json")
+	flag.StringVar(&cacheDir, "cache", "", "Cache the blocks of unchanged inputs in the given directory")
+	flag.BoolVar(&opts.stream, "stream", false, "Read inputs one at a time, and write text outputs to temporary files instead of keeping them in memory")
+	flag.BoolVar(&opts.inputDirs, "input-dirs", false, "Write the outputs of every input to a subdirectory named after it")
 	flag.Parse()
+	setLogFormat(logFormat)
 
-	inputCnt := len(inputFiles)
-
-	if inputCnt == 0 {
-		fmt.Fprint(os.Stderr, "No inputs specified\n")
-		flag.Usage()
+	policy, err := parseConflictPolicy(conflicts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-
-	inputs := make([][]byte, 0, inputCnt)
-
-	for _, file := range inputFiles {
-		log.verbose2f("Processing file %s\n", file)
-		input, err := ioutil.ReadFile(file)
-		if err != nil {
-			panic(err)
-		}
-		inputs = append(inputs, input)
+	opts.conflicts = policy
+	if cacheDir != "" {
+		opts.cache = newRenderCache(cacheDir)
 	}
 
-	rendered, err := render(inputs)
-	if err != nil {
-		panic(err)
+	if len(inputFiles) == 0 {
+		fmt.Fprint(os.Stderr, "No inputs specified\n")
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	if err := writeRendered(outDir, rendered); err != nil {
-		panic(err)
+	if err := process(inputFiles, outDir, opts, manifest); err != nil {
+		log.report(err)
+		os.Exit(1)
 	}
 }
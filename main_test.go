@@ -3,6 +3,14 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
 	"testing"
 
 	"gotest.tools/assert"
@@ -13,7 +21,7 @@ func TestMarkdownCrFileCrLf(t *testing.T) {
 	// therefore this is not expected to have any output.
 	input := "Foo\r```sh\r### FILE-CRLF: foo.txt\rshould have lf\rline ending\r```\r"
 
-	output, err := render([][]byte{[]byte(input)})
+	output, err := render([][]byte{[]byte(input)}, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 0)
@@ -48,7 +56,7 @@ func TestInvalidPragma(t *testing.T) {
 	var inputs [][]byte
 	inputs = append(inputs, input)
 
-	output, err := render(inputs)
+	output, err := render(inputs, renderOptions{})
 
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 0)
@@ -78,29 +86,118 @@ func TestPragmaParser(t *testing.T) {
 	assert.Assert(t, n == "foo/bar/baz/lol.txt")
 	assert.Assert(t, e == lineEndingCRLF)
 
+	// \ is a separator on every platform, as it is on windows
 	n, e = parsePragma([]byte(`### FILE-CRLF: foo\bar\baz\lol.txt`))
-	if isWindows {
-		assert.Assert(t, n == "foo/bar/baz/lol.txt")
-	} else {
-		assert.Assert(t, n == `foo\bar\baz\lol.txt`)
-	}
+	assert.Assert(t, n == "foo/bar/baz/lol.txt")
 	assert.Assert(t, e == lineEndingCRLF)
 
+	// All spellings of a path are the same output
+	n, _ = parsePragma([]byte("### FILE: ./foo//bar.sh"))
+	assert.Assert(t, n == "foo/bar.sh")
+
 	n, e = parsePragma([]byte("### FILE-CRLF: ### FILE-LF: recursive.txt"))
 	assert.Assert(t, n == "### FILE-LF: recursive.txt")
 	assert.Assert(t, e == lineEndingCRLF)
 
-	// systemd units can use \ in file names. But this means a directory with a file inside on windows
-	// both is valid depending on the platform. *sigh*
+	// systemd units can use \ in file names. But this means a directory with a file inside on windows,
+	// so it is a directory everywhere.
 	n, e = parsePragma([]byte("### FILE-LF: foo\\bar"))
+	assert.Assert(t, n == "foo/bar")
+	assert.Assert(t, e == lineEndingLF)
+}
+
+func TestLanguagePragmaParser(t *testing.T) {
+	n, e := parseLanguagePragma([]byte("// FILE-LF: data.json"), "json")
+	assert.Assert(t, n == "data.json")
+	assert.Assert(t, e == lineEndingLF)
+
+	n, _ = parseLanguagePragma([]byte("/* FILE: style.css */"), "CSS")
+	assert.Assert(t, n == "style.css")
+
+	n, _ = parseLanguagePragma([]byte("-- FILE: seed.sql"), "sql")
+	assert.Assert(t, n == "seed.sql")
+
+	n, e = parseLanguagePragma([]byte("rem FILE-CRLF: run.bat"), "bat")
+	assert.Assert(t, n == "run.bat")
+	assert.Assert(t, e == lineEndingCRLF)
+
+	n, _ = parseLanguagePragma([]byte(":: FILE: run.cmd"), "cmd")
+	assert.Assert(t, n == "run.cmd")
 
-	if isWindows {
-		assert.Assert(t, n == "foo/bar")
-	} else {
-		assert.Assert(t, n == "foo\\bar")
+	n, _ = parseLanguagePragma([]byte("<!-- FILE: index.html -->"), "html")
+	assert.Assert(t, n == "index.html")
+
+	n, _ = parseLanguagePragma([]byte("<# FILE: setup.ps1 #>"), "powershell")
+	assert.Assert(t, n == "setup.ps1")
+
+	// ### works regardless of the language
+	n, _ = parseLanguagePragma([]byte("### FILE: foo.lua"), "lua")
+	assert.Assert(t, n == "foo.lua")
+
+	// Comment syntax of a different language
+	n, _ = parseLanguagePragma([]byte("// FILE: foo.sh"), "sh")
+	assert.Assert(t, n == "")
+
+	n, _ = parseLanguagePragma([]byte("-- FILE: foo.txt"), "")
+	assert.Assert(t, n == "")
+
+	// # is a comment in these languages anyway, only ### is a pragma
+	n, _ = parseLanguagePragma([]byte("# FILE: foo.sh"), "sh")
+	assert.Assert(t, n == "")
+
+	// REM needs to be a separate word
+	n, _ = parseLanguagePragma([]byte("REMFILE: foo.bat"), "bat")
+	assert.Assert(t, n == "")
+}
+
+func TestValidatePath(t *testing.T) {
+	valid := []string{
+		"foo.sh",
+		"foo/bar/baz.txt",
+		`foo\bar.service`,
+		"./foo.sh",
+		".hidden",
+		"..foo",
+		"with space.txt",
+		"console.log",
+	}
+	invalid := []string{
+		"",
+		"/etc/passwd",
+		`\temp\evil.bat`,
+		`\\server\share\evil.bat`,
+		"//server/share/evil.bat",
+		`C:\temp\evil.bat`,
+		"C:/temp/evil.bat",
+		"c:evil.bat",
+		"../resolve.conf",
+		`..\..\something.txt`,
+		`foo\..\..\bar`,
+		"CON",
+		"nul.txt",
+		"logs/Com1.log",
+		"LPT9",
+		"foo/aux.tar.gz",
+		"setup.",
+		"setup ",
+		"dir./foo",
+		"foo\x00bar",
+		"foo\tbar",
+		"foo\x7f",
+		"data.txt:stream",
+		"what?.txt",
+		"a*b",
+		`"quoted"`,
+		"a<b>c",
+		"a|b",
 	}
 
-	assert.Assert(t, e == lineEndingLF)
+	for _, path := range valid {
+		assert.Assert(t, validatePath(path) == nil, path)
+	}
+	for _, path := range invalid {
+		assert.Assert(t, validatePath(path) != nil, path)
+	}
 }
 
 func TestHasDirUp(t *testing.T) {
@@ -111,4 +208,608 @@ func TestHasDirUp(t *testing.T) {
 	assert.Assert(t, hasDirUp("f..oo") == false)
 	assert.Assert(t, hasDirUp(`foo/../bar`) == true)
 	assert.Assert(t, hasDirUp(`foo/..`) == true)
+	assert.Assert(t, hasDirUp(`..\foo`) == true)
+	assert.Assert(t, hasDirUp(`foo\..\bar`) == true)
+}
+
+func TestInfoAttributes(t *testing.T) {
+	a, warnings := parseInfoAttributes([]byte("sh {file=setup.sh eol=lf mode=0755}"))
+	assert.Assert(t, len(warnings) == 0)
+	assert.Assert(t, a.path == "setup.sh")
+	assert.Assert(t, a.lineEnding == lineEndingLF)
+	assert.Assert(t, a.mode == 0755)
+
+	a, _ = parseInfoAttributes([]byte(`bat {eol=CRLF file="with space/run.bat"}`))
+	assert.Assert(t, a.path == "with space/run.bat")
+	assert.Assert(t, a.lineEnding == lineEndingCRLF)
+	assert.Assert(t, a.mode == 0)
+
+	// No attribute list at all
+	a, _ = parseInfoAttributes([]byte("sh file=foo.sh"))
+	assert.Assert(t, a.path == "")
+
+	// Invalid values are ignored
+	a, warnings = parseInfoAttributes([]byte("{file=foo.sh eol=crfl mode=999 bogus=1}"))
+	assert.Assert(t, len(warnings) == 3)
+	assert.Assert(t, warnings[0].code == codeInvalidAttribute)
+	assert.Assert(t, a.path == "foo.sh")
+	assert.Assert(t, a.lineEnding == lineEndingUnknown)
+	assert.Assert(t, a.mode == 0)
+}
+
+func TestHiddenPragma(t *testing.T) {
+	a, _, ok := parseHiddenPragma([]byte("<!-- markli: file=hello.sh eol=lf -->\n"))
+	assert.Assert(t, ok)
+	assert.Assert(t, a.path == "hello.sh")
+	assert.Assert(t, a.lineEnding == lineEndingLF)
+
+	a, _, ok = parseHiddenPragma([]byte("<!--markli:\nfile=\"a b.txt\"\nmode=0600\n-->"))
+	assert.Assert(t, ok)
+	assert.Assert(t, a.path == "a b.txt")
+	assert.Assert(t, a.mode == 0600)
+
+	_, _, ok = parseHiddenPragma([]byte("<!-- markli: eol=lf -->"))
+	assert.Assert(t, !ok)
+
+	_, _, ok = parseHiddenPragma([]byte("<!-- file=hello.sh -->"))
+	assert.Assert(t, !ok)
+
+	_, _, ok = parseHiddenPragma([]byte("<div><!-- markli: file=hello.sh --></div>"))
+	assert.Assert(t, !ok)
+}
+
+func TestDedent(t *testing.T) {
+	lines := func(l ...string) [][]byte {
+		var result [][]byte
+		for _, s := range l {
+			result = append(result, []byte(s))
+		}
+		return result
+	}
+
+	assert.DeepEqual(t, dedent(lines("  a\n", "    b\n", "  c\n")), lines("a\n", "  b\n", "c\n"))
+
+	// Blank lines don't count
+	assert.DeepEqual(t, dedent(lines("    a\n", "\n", "  \n", "    b\n")), lines("a\n", "\n", "\n", "b\n"))
+
+	// Tabs and spaces are not mixed up
+	assert.DeepEqual(t, dedent(lines("\ta\n", "  b\n")), lines("\ta\n", "  b\n"))
+	assert.DeepEqual(t, dedent(lines("\t a\n", "\t\tb\n")), lines(" a\n", "\tb\n"))
+
+	// Nothing to do
+	assert.DeepEqual(t, dedent(lines("a\n", "  b\n")), lines("a\n", "  b\n"))
+}
+
+func TestTextEncoding(t *testing.T) {
+	out, err := encodingUTF8.encode([]byte("€"))
+	assert.Assert(t, err == nil)
+	assertOutput(t, out, "€")
+
+	out, err = encodingUTF16BE.encode([]byte("a€😀"))
+	assert.Assert(t, err == nil)
+	assertOutput(t, out, "\xfe\xff\x00a\x20\xac\xd8\x3d\xde\x00")
+
+	out, err = encodingUTF16LE.encode([]byte("😀"))
+	assert.Assert(t, err == nil)
+	assertOutput(t, out, "\xff\xfe\x3d\xd8\x00\xde")
+
+	out, err = encodingLatin1.encode([]byte("ÿ"))
+	assert.Assert(t, err == nil)
+	assertOutput(t, out, "\xff")
+
+	_, err = encodingLatin1.encode([]byte("a\nb\r\nc\rd€"))
+	assert.Error(t, err, `line 4: character '€' can't be represented in latin1`)
+
+	_, err = encodingUTF16LE.encode([]byte("\xff"))
+	assert.Error(t, err, "line 1: invalid UTF-8")
+}
+
+func TestRenderEncodingError(t *testing.T) {
+	input := "```bat {file=euro.bat encoding=latin1}\necho 5€\n```\n"
+
+	_, err := render([][]byte{[]byte(input)}, renderOptions{})
+
+	assert.Error(t, err, `euro.bat: line 1: character '€' can't be represented in latin1`)
+
+	// Errors of other outputs are reported as well
+	input = "```json {file=a.json}\n{,}\n```\n\n```{file=b.txt encoding=latin1}\n5€\n```\n"
+	dir := getTempDir(t)
+	for _, stream := range []bool{false, true} {
+		_, err = render([][]byte{[]byte(input)}, renderOptions{validate: true, stream: stream, streamDir: dir})
+		assert.Error(t, err, "a.json (line 2, input 1): invalid JSON: invalid character ',' looking for beginning of object key string\n"+
+			`b.txt: line 1: character '€' can't be represented in latin1`)
+	}
+}
+
+func TestRenderSorted(t *testing.T) {
+	input := "```sh {file=c.sh}\necho c\n```\n" +
+		"```sh {file=a/z.sh}\necho z\n```\n" +
+		"```sh {file=b.sh}\necho b\n```\n" +
+		"```sh {file=a.sh}\necho a\n```\n"
+
+	for i := 0; i < 10; i++ {
+		output, err := render([][]byte{[]byte(input)}, renderOptions{})
+		assert.Assert(t, err == nil)
+
+		var paths []string
+		for _, sc := range output {
+			paths = append(paths, sc.path)
+		}
+		assert.DeepEqual(t, paths, []string{"a.sh", "a/z.sh", "b.sh", "c.sh"})
+	}
+
+	output, _ := render([][]byte{[]byte(input)}, renderOptions{})
+	assert.Assert(t, output.has("b.sh"))
+	assert.Assert(t, !output.has("d.sh"))
+	assertOutput(t, output.get("b.sh").content, "echo b\n")
+}
+
+func TestWhitespaceNormalize(t *testing.T) {
+	normalize := func(opts whitespaceOptions, content string, ending string) string {
+		return string(opts.normalize([]byte(content), []byte(ending)))
+	}
+
+	opts := whitespaceOptions{finalNewline: true}
+	assert.Equal(t, normalize(opts, "a", "\n"), "a\n")
+	assert.Equal(t, normalize(opts, "a\r\n\r\n  \r\n", "\r\n"), "a\r\n")
+	assert.Equal(t, normalize(opts, "\n\n", "\n"), "")
+	assert.Equal(t, normalize(opts, "", "\n"), "")
+
+	opts = whitespaceOptions{trimTrailing: true}
+	assert.Equal(t, normalize(opts, "a \t\rb  \r", "\r"), "a\rb\r")
+	assert.Equal(t, normalize(opts, "a  ", "\n"), "a")
+
+	opts = whitespaceOptions{stripLeadingBlank: true}
+	assert.Equal(t, normalize(opts, "\n \na\n\nb\n", "\n"), "a\n\nb\n")
+
+	opts = whitespaceOptions{expandTabs: 4}
+	assert.Equal(t, normalize(opts, "\ta\tb\n  \tc\n", "\n"), "    a   b\n    c\n")
+
+	opts = whitespaceOptions{unexpandTabs: 2}
+	assert.Equal(t, normalize(opts, "     a  b\n", "\n"), "\t\t a  b\n")
+
+	// Nothing to do
+	opts = whitespaceOptions{}
+	assert.Equal(t, normalize(opts, "\n\ta  \n\n", "\n"), "\n\ta  \n\n")
+}
+
+func TestAttributeMerge(t *testing.T) {
+	newAttrs := func(attrs string) blockAttributes {
+		a, _ := parseInfoAttributes([]byte("{" + attrs + "}"))
+		return a
+	}
+
+	a := newAttrs("file=a.sh eol=lf")
+	conflicts := a.merge(newAttrs("file=a.sh mode=0700 final-newline=true"), conflictFirstWins)
+	assert.Assert(t, len(conflicts) == 0)
+	assert.Assert(t, a.lineEnding == lineEndingLF)
+	assert.Assert(t, a.mode == 0700)
+	assert.Assert(t, *a.whitespace.finalNewline)
+
+	conflicts = a.merge(newAttrs("eol=crlf mode=0700 final-newline=false encoding=latin1"), conflictFirstWins)
+	assert.DeepEqual(t, conflicts, []string{
+		"eol=crlf conflicts with eol=lf",
+		"final-newline=false conflicts with final-newline=true",
+	})
+	assert.Assert(t, a.lineEnding == lineEndingLF)
+	assert.Assert(t, *a.whitespace.finalNewline)
+	assert.Assert(t, a.encoding == encodingLatin1)
+
+	conflicts = a.merge(newAttrs("eol=crlf mode=0644"), conflictLastWins)
+	assert.DeepEqual(t, conflicts, []string{
+		"eol=crlf conflicts with eol=lf",
+		"mode=0644 conflicts with mode=0700",
+	})
+	assert.Assert(t, a.lineEnding == lineEndingCRLF)
+	assert.Assert(t, a.mode == 0644)
+}
+
+func TestFindCollisions(t *testing.T) {
+	collisions := findCollisions([]string{
+		"setup.ps1",
+		"dir/File.txt",
+		"Setup.PS1",
+		"other.txt",
+		"DIR/file.txt",
+		"SETUP.ps1",
+		"Stra\u00dfe.txt",
+		"STRASSE.txt",
+		"./x.sh",
+		"x.sh",
+		"a//b.sh",
+		"a/b.sh",
+	})
+	assert.DeepEqual(t, collisions, [][]string{
+		{"./x.sh", "x.sh"},
+		{"DIR/file.txt", "dir/File.txt"},
+		{"SETUP.ps1", "Setup.PS1", "setup.ps1"},
+		{"STRASSE.txt", "Stra\u00dfe.txt"},
+		{"a//b.sh", "a/b.sh"},
+	})
+
+	assert.Assert(t, len(findCollisions([]string{"a.txt", "b.txt", "a/b.txt"})) == 0)
+	assert.DeepEqual(t, findCollisions([]string{`a\b.txt`, "a/b.txt"}), [][]string{{"a/b.txt", `a\b.txt`}})
+}
+
+func TestLayoutPragma(t *testing.T) {
+	a, _, ok := parseLayoutPragma([]byte("### DIR: logs mode=0750"))
+	assert.Assert(t, ok)
+	assert.Assert(t, a.kind == outputDir)
+	assert.Assert(t, a.path == "logs")
+	assert.Assert(t, a.mode == 0750)
+
+	a, _, ok = parseLayoutPragma([]byte("###DIR:var/cache  "))
+	assert.Assert(t, ok)
+	assert.Assert(t, a.path == "var/cache")
+	assert.Assert(t, a.mode == 0)
+
+	a, _, ok = parseLayoutPragma([]byte("### LINK: current  ->  releases/v2\n"))
+	assert.Assert(t, ok)
+	assert.Assert(t, a.kind == outputLink)
+	assert.Assert(t, a.path == "current")
+	assert.Assert(t, a.target == "releases/v2")
+
+	_, _, ok = parseLayoutPragma([]byte("### LINK: current"))
+	assert.Assert(t, !ok)
+
+	_, _, ok = parseLayoutPragma([]byte("### FILE: foo"))
+	assert.Assert(t, !ok)
+}
+
+func TestValidateLinkTarget(t *testing.T) {
+	assert.Assert(t, validateLinkTarget("current", "releases/v2") == nil)
+	assert.Assert(t, validateLinkTarget("a/b/link", "../../c") == nil)
+	assert.Assert(t, validateLinkTarget("a/link", `..\c`) == nil)
+	assert.Assert(t, validateLinkTarget("a/link", "..") == nil)
+
+	assert.Assert(t, validateLinkTarget("link", "") != nil)
+	assert.Assert(t, validateLinkTarget("link", "/etc/passwd") != nil)
+	assert.Assert(t, validateLinkTarget("link", `C:\Windows`) != nil)
+	assert.Assert(t, validateLinkTarget("link", "..") != nil)
+	assert.Assert(t, validateLinkTarget("a/link", "../../etc") != nil)
+	assert.Assert(t, validateLinkTarget("a/link", `..\..\etc`) != nil)
+	assert.Assert(t, validateLinkTarget("link", "nul") != nil)
+}
+
+func TestBinaryDecode(t *testing.T) {
+	lines := func(l ...string) [][]byte {
+		var result [][]byte
+		for _, s := range l {
+			result = append(result, []byte(s))
+		}
+		return result
+	}
+
+	data, _, err := encodingBase64.decode(lines("aGVs\r\n", "  bG8=\n"))
+	assert.Assert(t, err == nil)
+	assertOutput(t, data, "hello")
+
+	data, _, err = encodingHex.decode(lines("68 65\t6c\n", "6C6f\n"))
+	assert.Assert(t, err == nil)
+	assertOutput(t, data, "hello")
+
+	data, _, err = encodingHex.decode(nil)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(data) == 0)
+
+	_, index, err := encodingBase64.decode(lines("aGVs\n", "bG8=\n", "aGVs\n"))
+	assert.Assert(t, err != nil)
+	assert.Assert(t, index == 2)
+
+	_, index, err = encodingHex.decode(lines("00\n", "0x00\n"))
+	assert.Error(t, err, "invalid hex character 'x'")
+	assert.Assert(t, index == 1)
+
+	_, _, err = encodingUTF8.decode(lines("foo"))
+	assert.Assert(t, err != nil)
+}
+
+func TestManifestFormat(t *testing.T) {
+	output := outputList{
+		{path: "a.txt", content: []byte("a")},
+		{path: `b\\c.txt`, content: []byte("")},
+	}
+
+	manifest := string(buildManifest(output))
+	assert.Equal(t, manifest, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb  a.txt\n"+
+		`\e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  b\\\\c.txt`+"\n")
+
+	entries, err := parseManifest(strings.NewReader(manifest))
+	assert.Assert(t, err == nil)
+	assert.DeepEqual(t, entries[1].path, `b\\c.txt`)
+
+	// Binary mode marker of sha256sum and CRLF line endings
+	entries, err = parseManifest(strings.NewReader("CA978112CA1BBDCAFAC231B39A23DC4DA786EFF8147C4E72B9807785AFEE48BB *a.txt\r\n"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, entries[0].path == "a.txt")
+	assert.Assert(t, entries[0].sum == "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb")
+
+	_, err = parseManifest(strings.NewReader("1234  a.txt\n"))
+	assert.Error(t, err, "line 1: invalid format")
+}
+
+func TestDiagnosticsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.format = logJSON
+	log.outstream = &buf
+
+	input := "# Setup\n\n```sh\n### FILE: ../evil.sh\necho evil\n```\n\n" +
+		"```sh {file=a.sh bogus=1}\necho a\n```\n"
+	opts := renderOptions{inputNames: []string{"README.md"}}
+	output, err := render([][]byte{[]byte(input)}, opts)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 1)
+
+	assert.Equal(t, buf.String(),
+		`{"severity":"warning","code":"invalid-path","message":"using .. in paths is not allowed, ignoring it",`+
+			`"input":"README.md","line":4,"output":"../evil.sh"}`+"\n"+
+			`{"severity":"warning","code":"invalid-attribute","message":"unknown attribute 'bogus', ignoring it",`+
+			`"input":"README.md","line":9}`+"\n")
+
+	// Errors are reported one per line
+	buf.Reset()
+	log.report(errorList{
+		diagnostic{severity: severityError, code: codeChecksumMismatch, message: "checksum mismatch", output: "a.sh"},
+		errors.New("something else"),
+	})
+	assert.Equal(t, buf.String(),
+		`{"severity":"error","code":"checksum-mismatch","message":"checksum mismatch","output":"a.sh"}`+"\n"+
+			`{"severity":"error","message":"something else"}`+"\n")
+}
+
+func TestDiagnosticsText(t *testing.T) {
+	d := newDiagnostic(severityError, codeAttributeConflict, "eol=crlf conflicts with eol=lf")
+	assert.Error(t, d, "eol=crlf conflicts with eol=lf")
+
+	d.input = "README.md"
+	assert.Error(t, d, "README.md: eol=crlf conflicts with eol=lf")
+	d.line = 3
+	assert.Error(t, d, "README.md (line 3): eol=crlf conflicts with eol=lf")
+	d.output = "setup.sh"
+	assert.Error(t, d, "setup.sh (line 3, README.md): eol=crlf conflicts with eol=lf")
+}
+
+func TestQuiet(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = &buf
+	log.quiet = true
+	log.verbosity = 3
+
+	input := "```sh {file=a.sh}\necho a\n```\n```sh {file=a.sh eol=crlf}\necho b\n```\n"
+	_, err := render([][]byte{[]byte(input)}, renderOptions{})
+	assert.Assert(t, err == nil)
+	assert.Equal(t, buf.String(), "")
+
+	// Errors are still shown
+	log.report(errors.New("failed"))
+	assert.Equal(t, buf.String(), "failed\n")
+}
+
+func TestRenderParallel(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = &buf
+
+	// Blocks of all inputs are appended in the order of the inputs
+	var inputs [][]byte
+	var names []string
+	var expected, warnings strings.Builder
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("doc%02d.md", i)
+		input := fmt.Sprintf("```sh {file=all.sh bogus=%d}\necho %d\n```\n", i, i)
+		inputs = append(inputs, []byte(input))
+		names = append(names, name)
+		fmt.Fprintf(&expected, "echo %d\n", i)
+		fmt.Fprintf(&warnings, "Warning: %s (line 2): unknown attribute 'bogus', ignoring it\n", name)
+	}
+
+	output, err := render(inputs, renderOptions{inputNames: names})
+	assert.Assert(t, err == nil)
+	assert.Equal(t, string(output.get("all.sh").content), expected.String())
+	assert.Equal(t, buf.String(), warnings.String())
+}
+
+func TestExtractGFM(t *testing.T) {
+	// Extensions add node kinds, which are walked like all others
+	input := "| a | b |\n|---|---|\n| ~~c~~ | https://example.com |\n\n" +
+		"- [x] done\n\n  ```sh {file=a.sh}\n  echo a\n  ```\n"
+	ex := newExtractor().extract([]byte(input))
+	assert.Assert(t, len(ex.diagnostics) == 0)
+	assert.Assert(t, len(ex.blocks) == 1)
+	assert.Equal(t, ex.blocks[0].attrs.path, "a.sh")
+	assert.Equal(t, ex.blocks[0].line, 8)
+	assert.Equal(t, string(bytes.Join(ex.blocks[0].lines, nil)), "echo a\n")
+}
+
+func TestLineWriter(t *testing.T) {
+	// Writing line by line gives the same result as normalizing and encoding
+	// the whole content, no matter how the content is split
+	contents := []string{
+		"", "\n", "\n\n", "a", "a\n", "\n\na\t \n\tb  \n\n \n", "  x\n\n", "\t\n \n",
+		"héllo\nwörld", "    four\n        eight\n", "a\n\n\nb",
+	}
+	options := []whitespaceOptions{
+		{},
+		{finalNewline: true},
+		{stripLeadingBlank: true},
+		{finalNewline: true, stripLeadingBlank: true, trimTrailing: true},
+		{expandTabs: 4},
+		{unexpandTabs: 4, trimTrailing: true},
+	}
+	encodings := []textEncoding{encodingUTF8, encodingUTF8BOM, encodingUTF16LE, encodingLatin1}
+
+	for _, ending := range []lineEndingStyle{lineEndingLF, lineEndingCRLF} {
+		for _, content := range contents {
+			content := bytes.ReplaceAll([]byte(content), []byte("\n"), ending.bytes())
+			for _, opts := range options {
+				for _, enc := range encodings {
+					expected, err := enc.encode(opts.normalize(content, ending.bytes()))
+					assert.NilError(t, err)
+
+					for split := 1; split <= len(content)+1; split++ {
+						var buf bytes.Buffer
+						lw := newLineWriter(&buf, opts, ending.bytes(), enc)
+						for i := 0; i < len(content); i += split {
+							end := i + split
+							if end > len(content) {
+								end = len(content)
+							}
+							_, err := lw.Write(content[i:end])
+							assert.NilError(t, err)
+						}
+						assert.NilError(t, lw.Close())
+						assert.Equal(t, buf.String(), string(expected),
+							"content %q, options %+v, encoding %s, split %d", content, opts, enc, split)
+					}
+				}
+			}
+		}
+	}
+
+	// Encoding errors are reported at the same line
+	lw := newLineWriter(ioutil.Discard, whitespaceOptions{}, []byte("\n"), encodingLatin1)
+	_, err := lw.Write([]byte("a\nb\n€\n"))
+	assert.Error(t, err, "line 3: character '€' can't be represented in latin1")
+}
+
+func TestSpoolFile(t *testing.T) {
+	// Spooled lines are encoded like the whole content, also lines longer
+	// than the buffer used for reading them
+	long := append(bytes.Repeat([]byte("x "), 40*1024), '\n')
+	lines := [][]byte{[]byte("\ta  \r\n"), long, []byte("\n"), []byte("b\rc\n"), []byte("\n")}
+	opts := whitespaceOptions{finalNewline: true, trimTrailing: true, expandTabs: 2}
+
+	for _, ending := range []lineEndingStyle{lineEndingLF, lineEndingCRLF, lineEndingCR} {
+		for _, enc := range []textEncoding{encodingUTF8, encodingUTF16BE} {
+			var content []byte
+			for _, line := range lines {
+				content = append(content, withLineEnding(line, ending)...)
+			}
+			expected, err := enc.encode(opts.normalize(content, ending.bytes()))
+			assert.NilError(t, err)
+
+			spool, err := newSpoolFile(getTempDir(t))
+			assert.NilError(t, err)
+			w := bufio.NewWriter(nil)
+			assert.NilError(t, spool.append(w, lines[:2]))
+			assert.NilError(t, spool.append(w, lines[2:]))
+			assert.Equal(t, spool.lines, len(lines))
+
+			sum, err := spool.encode(opts, ending, enc)
+			assert.NilError(t, err)
+			encoded, err := ioutil.ReadFile(spool.name)
+			assert.NilError(t, err)
+			assert.Assert(t, bytes.Equal(encoded, expected), "line ending %s, encoding %s", ending, enc)
+			assert.Equal(t, sum, fmt.Sprintf("%x", sha256.Sum256(expected)))
+		}
+	}
+}
+
+func TestInputDirs(t *testing.T) {
+	linux := "```sh {file=setup.sh}\necho linux\n```\n" +
+		"```sh {file=common.sh merge=true}\necho common linux\n```\n" +
+		"```\n### DIR: logs merge=true\n### DIR: cache\n```\n"
+	windows := "---\ntitle: Windows\nmarkli-dir: win\n---\n\n" +
+		"```sh {file=setup.sh}\necho windows\n```\n" +
+		"<!-- markli: file=common.sh merge=true -->\n```sh\necho common windows\n```\n"
+	inputs := [][]byte{[]byte(linux), []byte(windows)}
+	opts := renderOptions{inputDirs: true, inputNames: []string{"docs/linux.md", "windows.md"}}
+
+	output, err := render(inputs, opts)
+	assert.NilError(t, err)
+	var paths []string
+	for _, sc := range output {
+		paths = append(paths, sc.path)
+	}
+	assert.DeepEqual(t, paths, []string{"common.sh", "linux/cache", "linux/setup.sh", "logs", "win/setup.sh"})
+	assert.Equal(t, string(output.get("linux/setup.sh").content), "echo linux\n")
+	assert.Equal(t, string(output.get("win/setup.sh").content), "echo windows\n")
+	assert.Equal(t, string(output.get("common.sh").content), "echo common linux\necho common windows\n")
+
+	// Without input-dirs, everything is merged
+	opts.inputDirs = false
+	output, err = render(inputs, opts)
+	assert.NilError(t, err)
+	assert.Equal(t, string(output.get("setup.sh").content), "echo linux\necho windows\n")
+
+	// Inputs must not share a directory
+	opts.inputDirs = true
+	opts.inputNames = []string{"linux/setup.md", "windows/setup.md"}
+	_, err = render([][]byte{[]byte(linux), []byte(linux)}, opts)
+	assert.Error(t, err, "windows/setup.md: output directory setup is already used by linux/setup.md, "+
+		"use markli-dir in the front matter to choose another one")
+
+	_, err = render([][]byte{[]byte("---\nmarkli-dir: ../up\n---\n" + linux)}, opts)
+	assert.Error(t, err, "linux/setup.md: invalid output directory ../up: using .. in paths is not allowed")
+
+	_, err = render([][]byte{[]byte("---\nmarkli-dir: ./\n---\n" + linux)}, opts)
+	assert.Error(t, err, "linux/setup.md: invalid output directory .: use merge=true for outputs in the output directory itself")
+}
+
+func TestFrontMatter(t *testing.T) {
+	dir, warnings := parseFrontMatter([]byte("---\r\nmarkli-dir: docs/linux\r\n...\r\n# Title\n"))
+	assert.Equal(t, dir, "docs/linux")
+	assert.Assert(t, len(warnings) == 0)
+
+	// Thematic breaks are not front matter
+	dir, warnings = parseFrontMatter([]byte("---\n\n# Title: *a*\n\n---\n"))
+	assert.Equal(t, dir, "")
+	assert.Assert(t, len(warnings) == 0)
+
+	_, warnings = parseFrontMatter([]byte("---\nmarkli-dir: [a\n---\n"))
+	assert.Assert(t, len(warnings) == 1)
+	assert.Equal(t, warnings[0].line, 1)
+	assert.Equal(t, warnings[0].code, codeInvalidAttribute)
+}
+
+func TestDisabledRules(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = &buf
+
+	disabled, err := parseDisabledRules([]string{codeEmptyBlock, codeInvalidPath})
+	assert.Assert(t, err == nil)
+	log.disabled = disabled
+	log.problems = 0
+
+	log.diagnose(newDiagnostic(severityWarning, codeEmptyBlock, "code block is empty"))
+	log.diagnose(newDiagnostic(severityWarning, codeNearMiss, "looks like a pragma"))
+	assert.Equal(t, buf.String(), "Warning: looks like a pragma\n")
+	assert.Assert(t, log.problems == 1)
+
+	_, err = parseDisabledRules([]string{"bogus"})
+	assert.ErrorContains(t, err, "unknown rule 'bogus'")
+}
+
+func TestExternalValidator(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil || isWindows {
+		t.Skip("needs a POSIX shell")
+	}
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = &buf
+
+	// Reports every TODO as warning, like "-:2:# TODO: test"
+	v := &externalValidator{
+		Files:   "*.sh",
+		Command: commandLine{"sh", "-c", `grep -n TODO | sed 's/^/-:/'`},
+	}
+	assert.Assert(t, v.init(".") == nil)
+
+	input := "# Setup\n\n```sh\n### FILE: setup.sh\necho a\n```\n\n" +
+		"```sh\n### FILE: setup.sh\n# TODO: test\necho b\n```\n\n```\n### FILE: other.txt\nTODO\n```\n"
+	_, err := render([][]byte{[]byte(input)}, renderOptions{validators: []*externalValidator{v}})
+	assert.Assert(t, err == nil)
+	assert.Equal(t, buf.String(), "Warning: setup.sh (line 10, input 1): sh: # TODO: test\n")
+
+	v.Command[2] = `cat >/dev/null; echo "-:2:1: error: broken"; exit 1`
+	_, err = render([][]byte{[]byte(input)}, renderOptions{validators: []*externalValidator{v}})
+	assert.Error(t, err, "setup.sh (line 10, input 1): sh: broken")
+
+	// Failures without any diagnostics
+	v.Command[2] = "echo failed; exit 2"
+	_, err = render([][]byte{[]byte(input)}, renderOptions{validators: []*externalValidator{v}})
+	assert.Error(t, err, "setup.sh: sh: failed")
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Default name of the manifest, as written by sha256sum
+const defaultManifestName = "SHA256SUMS"
+
+type manifestEntry struct {
+	path string
+	sum  string
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildManifest lists the checksums of all files in output, sorted by path.
+// The format is compatible with sha256sum, including its escaping of
+// backslashes in file names.
+func buildManifest(output outputList) []byte {
+	var buf bytes.Buffer
+	for _, sc := range output {
+		if sc.attrs.kind != outputFile {
+			continue
+		}
+		path := sc.path
+		sum := sha256Hex(sc.content)
+		if sc.streamed {
+			sum = sc.sum
+		}
+		if strings.Contains(path, `\`) {
+			fmt.Fprintf(&buf, "\\%s  %s\n", sum, strings.Replace(path, `\`, `\\`, -1))
+		} else {
+			fmt.Fprintf(&buf, "%s  %s\n", sum, path)
+		}
+	}
+	return buf.Bytes()
+}
+
+func writeManifest(outDir string, name string, output outputList) error {
+	if output.has(name) {
+		return fmt.Errorf("manifest %s would overwrite an output", name)
+	}
+	if err := checkSymlinks(outDir, name, outputFile); err != nil {
+		return err
+	}
+	path := filepath.Join(outDir, name)
+	log.verbosef("Writing manifest: %s\n", path)
+	return ioutil.WriteFile(path, buildManifest(output), 0644)
+}
+
+func parseManifest(r io.Reader) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, `\`)
+		if escaped {
+			line = line[1:]
+		}
+		// sha256sum uses " *" for binary mode, both are the same here
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 || len(fields[1]) < 2 {
+			return nil, fmt.Errorf("line %d: invalid format", lineNo)
+		}
+		path := fields[1][1:]
+		if escaped {
+			path = strings.Replace(path, `\\`, `\`, -1)
+		}
+		entries = append(entries, manifestEntry{path: path, sum: strings.ToLower(fields[0])})
+	}
+	return entries, scanner.Err()
+}
+
+func manifestError(code string, entry manifestEntry, err interface{}) diagnostic {
+	d := newDiagnostic(severityError, code, "%v", err)
+	d.output = entry.path
+	return d
+}
+
+// verifyManifest checks all files listed in the manifest within dir. All
+// missing or modified files are returned as errors.
+func verifyManifest(dir string, name string) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := parseManifest(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	var errs errorList
+	for _, entry := range entries {
+		if err := validatePath(entry.path); err != nil {
+			errs = append(errs, manifestError(codeInvalidPath, entry, err))
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(entry.path)))
+		if err != nil {
+			errs = append(errs, manifestError(codeMissingOutput, entry, err))
+			continue
+		}
+		if sha256Hex(content) != entry.sum {
+			errs = append(errs, manifestError(codeChecksumMismatch, entry, "checksum mismatch"))
+			continue
+		}
+		log.verbosef("%s: OK\n", entry.path)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -10,7 +10,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 )
@@ -79,6 +82,9 @@ OUTER:
 }
 
 func TestMain(m *testing.M) {
+	// Warnings about the examples are expected
+	log.outstream = ioutil.Discard
+
 	os.RemoveAll(baseDir)
 
 	if err := os.Mkdir(baseDir, 0755); err != nil {
@@ -94,8 +100,9 @@ func TestMain(m *testing.M) {
 func TestOutputFile(t *testing.T) {
 	dir := getTempDir(t)
 
-	output := make(map[string][]byte)
-	output["foo.txt"] = []byte("bar")
+	output := outputList{
+		{path: "foo.txt", content: []byte("bar")},
+	}
 
 	writeRendered(dir, output)
 
@@ -110,8 +117,9 @@ func TestOutputFile(t *testing.T) {
 func TestOutputDir(t *testing.T) {
 	dir := getTempDir(t)
 
-	output := make(map[string][]byte)
-	output["abc/def/foo.txt"] = []byte("bar")
+	output := outputList{
+		{path: "abc/def/foo.txt", content: []byte("bar")},
+	}
 
 	writeRendered(dir, output)
 
@@ -127,10 +135,11 @@ func TestOutputDir(t *testing.T) {
 func TestOutputMulti(t *testing.T) {
 	dir := getTempDir(t)
 
-	output := make(map[string][]byte)
-	output["abc/def/foo.txt"] = []byte("bar")
-	output["abc/foo.txt"] = []byte("baz")
-	output["foo.txt"] = []byte("zab")
+	output := outputList{
+		{path: "abc/def/foo.txt", content: []byte("bar")},
+		{path: "abc/foo.txt", content: []byte("baz")},
+		{path: "foo.txt", content: []byte("zab")},
+	}
 
 	writeRendered(dir, output)
 
@@ -147,3 +156,373 @@ func TestOutputMulti(t *testing.T) {
 	}
 	validateDirStruct(t, dir, files)
 }
+
+func TestOutputMode(t *testing.T) {
+	if isWindows {
+		t.Skip("file modes are not supported on windows")
+	}
+	dir := getTempDir(t)
+
+	output := outputList{
+		{path: "default.sh", content: []byte("foo")},
+		{path: "private.sh", content: []byte("bar"), attrs: blockAttributes{mode: 0700}},
+	}
+
+	writeRendered(dir, output)
+
+	validateFile(t, "default.sh", []byte("foo"))
+	validateFile(t, "private.sh", []byte("bar"))
+
+	info, err := os.Stat(filepath.Join(dir, "private.sh"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, info.Mode().Perm() == 0700)
+}
+
+func TestOutputSymlinks(t *testing.T) {
+	if isWindows {
+		t.Skip("symlinks need special privileges on windows")
+	}
+	dir := getTempDir(t)
+	outside, err := ioutil.TempDir(baseDir, "outside")
+	assert.Assert(t, err == nil)
+
+	// A symlink within the output directory is fine, as long as it stays inside
+	assert.Assert(t, os.Mkdir(filepath.Join(dir, "real"), 0755) == nil)
+	assert.Assert(t, os.Symlink("real", filepath.Join(dir, "inside")) == nil)
+	absInside, err := filepath.Abs(filepath.Join(dir, "real"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, os.Symlink(absInside, filepath.Join(dir, "absinside")) == nil)
+
+	absOutside, err := filepath.Abs(outside)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, os.Symlink(absOutside, filepath.Join(dir, "escape")) == nil)
+	assert.Assert(t, os.Symlink("real/../..", filepath.Join(dir, "up")) == nil)
+
+	assert.Assert(t, ioutil.WriteFile(filepath.Join(outside, "target.txt"), []byte("keep"), 0644) == nil)
+	assert.Assert(t, os.Symlink(filepath.Join(absOutside, "target.txt"), filepath.Join(dir, "link.txt")) == nil)
+
+	output := outputList{
+		{path: "absinside/bar.txt", content: []byte("bar")},
+		{path: "escape/evil.txt", content: []byte("evil")},
+		{path: "inside/foo.txt", content: []byte("foo")},
+		{path: "link.txt", content: []byte("evil")},
+		{path: "up/evil.txt", content: []byte("evil")},
+	}
+
+	err = writeRendered(dir, output)
+
+	assert.Assert(t, err != nil)
+	t.Log(err)
+	errs, ok := err.(errorList)
+	assert.Assert(t, ok)
+	assert.Assert(t, len(errs) == 3)
+
+	validateFile(t, "real/foo.txt", []byte("foo"))
+	validateFile(t, "real/bar.txt", []byte("bar"))
+
+	files, err := ioutil.ReadDir(outside)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(files) == 1)
+	content, err := ioutil.ReadFile(filepath.Join(outside, "target.txt"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, string(content) == "keep")
+}
+
+func TestOutputLayout(t *testing.T) {
+	if isWindows {
+		t.Skip("symlinks need special privileges on windows")
+	}
+	dir := getTempDir(t)
+
+	output := outputList{
+		{path: "current", attrs: blockAttributes{kind: outputLink, target: "releases/v2"}},
+		{path: "logs", attrs: blockAttributes{kind: outputDir, mode: 0750}},
+		{path: "releases/v2/run.sh", content: []byte("run")},
+	}
+
+	err := writeRendered(dir, output)
+	assert.Assert(t, err == nil)
+
+	validateFile(t, "releases/v2/run.sh", []byte("run"))
+	validateFile(t, "current/run.sh", []byte("run"))
+
+	info, err := os.Stat(filepath.Join(dir, "logs"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, info.IsDir())
+	assert.Assert(t, info.Mode().Perm() == 0750)
+
+	files := []string{
+		"logs",
+		"current",
+		"releases",
+		"releases/v2",
+		"releases/v2/run.sh",
+	}
+	validateDirStruct(t, dir, files)
+
+	// Existing links are replaced, other files are not
+	output = outputList{
+		{path: "current", attrs: blockAttributes{kind: outputLink, target: "releases/v3"}},
+		{path: "releases/v2/run.sh", attrs: blockAttributes{kind: outputLink, target: "../v3/run.sh"}},
+	}
+
+	err = writeRendered(dir, output)
+	assert.Assert(t, err != nil)
+	t.Log(err)
+
+	target, err := os.Readlink(filepath.Join(dir, "current"))
+	assert.Assert(t, err == nil)
+	assert.Assert(t, target == "releases/v3")
+	validateFile(t, "releases/v2/run.sh", []byte("run"))
+}
+
+func TestOutputLinkChain(t *testing.T) {
+	if isWindows {
+		t.Skip("symlinks need special privileges on windows")
+	}
+	dir := getTempDir(t)
+
+	// Each link is fine on its own, but d/e is the parent of the output
+	// directory, as d is the output directory itself
+	output := outputList{
+		{path: "d", attrs: blockAttributes{kind: outputLink, target: "."}},
+		{path: "d/e", attrs: blockAttributes{kind: outputLink, target: ".."}},
+	}
+
+	err := writeRendered(dir, output)
+	assert.ErrorContains(t, err, "leads outside of the output directory")
+
+	_, err = os.Lstat(filepath.Join(dir, "e"))
+	assert.Assert(t, os.IsNotExist(err))
+	validateDirStruct(t, dir, []string{"d"})
+}
+
+func TestOutputManifest(t *testing.T) {
+	dir := getTempDir(t)
+
+	output := outputList{
+		{path: "abc/def/foo.txt", content: []byte("baz")},
+		{path: "foo.txt", content: []byte("bar")},
+		{path: "logs", attrs: blockAttributes{kind: outputDir}},
+	}
+
+	assert.Assert(t, writeRendered(dir, output) == nil)
+	assert.Assert(t, writeManifest(dir, defaultManifestName, output) == nil)
+
+	manifest := "baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096  abc/def/foo.txt\n" +
+		"fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9  foo.txt\n"
+	validateFile(t, defaultManifestName, []byte(manifest))
+
+	assert.Assert(t, verifyManifest(dir, defaultManifestName) == nil)
+
+	// Modified and missing files are reported
+	assert.Assert(t, ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("modified"), 0644) == nil)
+	assert.Assert(t, os.Remove(filepath.Join(dir, "abc/def/foo.txt")) == nil)
+
+	err := verifyManifest(dir, defaultManifestName)
+	assert.Assert(t, err != nil)
+	errs, ok := err.(errorList)
+	assert.Assert(t, ok)
+	assert.Assert(t, len(errs) == 2)
+	assert.ErrorContains(t, errs[1], "foo.txt: checksum mismatch")
+
+	// The manifest must not replace an output
+	assert.Assert(t, writeManifest(dir, "foo.txt", output) != nil)
+}
+
+func TestOutputManifestSpellings(t *testing.T) {
+	dir := getTempDir(t)
+
+	// Different spellings of a path are one file, and one manifest entry
+	input := "```sh {file=./setup.sh}\necho a\n```\n\n```sh {file=setup.sh}\necho b\n```\n\n" +
+		"```\n### FILE: lib//util.sh\necho c\n```\n\n```\n### FILE: lib/util.sh\necho d\n```\n"
+
+	output, err := render([][]byte{[]byte(input)}, renderOptions{})
+	assert.Assert(t, err == nil)
+	assert.Assert(t, writeRendered(dir, output) == nil)
+	assert.Assert(t, writeManifest(dir, defaultManifestName, output) == nil)
+
+	manifest := "769a2edfc0a25180dfdf0526a0ed018b2be8c3937c602c1be05ad3c4096e4ff6  lib/util.sh\n" +
+		"a0432d83d1dff7096a32b9c5f929a1a6e4a0e21899955078c302b75f0ce0cca9  setup.sh\n"
+	validateFile(t, defaultManifestName, []byte(manifest))
+
+	assert.Assert(t, verifyManifest(dir, defaultManifestName) == nil)
+}
+
+func TestProcessSummary(t *testing.T) {
+	dir := getTempDir(t)
+
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = &buf
+
+	input := filepath.Join(dir, "README.md")
+	content := "```sh {file=a.sh}\necho a\n```\n```sh {file=../b.sh}\necho b\n```\n" +
+		"```sh {file=c/d.sh}\necho d\n```\n```\n### DIR: logs\n```\n"
+	assert.Assert(t, ioutil.WriteFile(input, []byte(content), 0644) == nil)
+
+	out := filepath.Join(dir, "out")
+	assert.Assert(t, process([]string{input}, out, renderOptions{}, "") == nil)
+	assert.Equal(t, buf.String(),
+		"Warning: ../b.sh (line 5, "+input+"): using .. in paths is not allowed, ignoring it\n"+
+			"2 files written to "+out+", 1 block skipped\n")
+
+	// Unchanged files are not written again
+	buf.Reset()
+	content = strings.Replace(content, "echo d", "echo e", 1)
+	assert.Assert(t, ioutil.WriteFile(input, []byte(content), 0644) == nil)
+	assert.Assert(t, process([]string{input}, out, renderOptions{}, "") == nil)
+	assert.Equal(t, buf.String(),
+		"Warning: ../b.sh (line 5, "+input+"): using .. in paths is not allowed, ignoring it\n"+
+			"1 file written to "+out+", 1 unchanged, 1 block skipped\n")
+
+	buf.Reset()
+	log.quiet = true
+	assert.Assert(t, process([]string{input}, out, renderOptions{}, "") == nil)
+	assert.Equal(t, buf.String(), "")
+}
+
+func TestLintFiles(t *testing.T) {
+	dir := getTempDir(t)
+
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = &buf
+
+	// Outputs are validated, even if assembling others failed
+	input := filepath.Join(dir, "README.md")
+	content := "```sh {file=a.sh eol=lf}\necho a\n```\n```sh {file=a.sh eol=crlf}\necho b\n```\n" +
+		"```json {file=b.json}\n{,}\n```\n"
+	assert.Assert(t, ioutil.WriteFile(input, []byte(content), 0644) == nil)
+
+	assert.Assert(t, lintFiles([]string{input}) == nil)
+	assert.Equal(t, buf.String(),
+		"a.sh (line 5, "+input+"): eol=crlf conflicts with eol=lf\n"+
+			"b.json (line 8, "+input+"): invalid JSON: invalid character ',' looking for beginning of object key string\n")
+}
+
+func TestRenderCache(t *testing.T) {
+	dir := getTempDir(t)
+	cache := newRenderCache(filepath.Join(dir, "cache"))
+
+	var buf bytes.Buffer
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = &buf
+
+	input := []byte("```sh {file=a.sh eol=crlf mode=0700 trim-trailing=true}\necho a  \n```\n" +
+		"```sh {file=../b.sh}\necho b\n```\n```\n### DIR: logs\n### LINK: current -> a.sh\n```\n" +
+		"```sh {file=a.sh dedent=true}\n  echo c\n```\n")
+	opts := renderOptions{cache: cache, inputNames: []string{"README.md"}}
+	expected, err := render([][]byte{input}, opts)
+	assert.Assert(t, err == nil)
+	warnings := buf.String()
+
+	// The cached blocks give the same outputs and warnings
+	_, ok := cache.load(input)
+	assert.Assert(t, ok)
+	buf.Reset()
+	output, err := render([][]byte{input}, opts)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, reflect.DeepEqual(output, expected))
+	assert.Equal(t, buf.String(), warnings)
+
+	// Cached inputs are not parsed again
+	assert.Assert(t, cache.store(input, extraction{blocks: []block{{
+		attrs: blockAttributes{kind: outputFile, path: "cached.sh"},
+		lines: [][]byte{[]byte("echo cached\n")},
+	}}}) == nil)
+	output, err = render([][]byte{input}, opts)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, len(output) == 1)
+	assert.Equal(t, string(output.get("cached.sh").content), "echo cached\n")
+
+	// Another version of markli doesn't use the entry
+	defer func(saved string) { version = saved }(version)
+	version = "other"
+	_, ok = cache.load(input)
+	assert.Assert(t, !ok)
+	output, err = render([][]byte{input}, opts)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, reflect.DeepEqual(output, expected))
+}
+
+func TestOutputUnchanged(t *testing.T) {
+	dir := getTempDir(t)
+	output := outputList{{path: "foo.txt", content: []byte("foo\n"), attrs: blockAttributes{mode: 0600}}}
+	assert.Assert(t, writeRendered(dir, output) == nil)
+
+	path := filepath.Join(dir, "foo.txt")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Assert(t, os.Chtimes(path, old, old) == nil)
+
+	// Unchanged files are not written, but still get their mode
+	output[0].attrs.mode = 0644
+	assert.Assert(t, writeRendered(dir, output) == nil)
+	info, err := os.Stat(path)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, info.ModTime().Equal(old))
+	if !isWindows {
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0644))
+	}
+
+	output[0].content = []byte("bar\n")
+	assert.Assert(t, writeRendered(dir, output) == nil)
+	validateFile(t, "foo.txt", []byte("bar\n"))
+}
+
+func TestOutputStreamed(t *testing.T) {
+	dir := getTempDir(t)
+
+	defer func(saved logger) { *log = saved }(*log)
+	log.outstream = ioutil.Discard
+
+	input := filepath.Join(dir, "README.md")
+	content := "```sh {file=a.sh trim-trailing=true}\n\n echo a  \n```\n" +
+		"```sh {file=a.sh eol=crlf}\necho b\n```\n" +
+		"- list\n\n  ```ps1 {file=b.ps1 encoding=utf-16le dedent=true}\n      Write-Host b\n  ```\n" +
+		"```json {file=c.json}\n{\"c\": 1}\n```\n" +
+		"```{file=d.bin encoding=hex}\n6d61726b6c69\n```\n" +
+		"```\n### DIR: logs\n```\n"
+	assert.Assert(t, ioutil.WriteFile(input, []byte(content), 0644) == nil)
+
+	buffered := filepath.Join(dir, "buffered")
+	opts := renderOptions{
+		whitespace: whitespaceOptions{finalNewline: true, stripLeadingBlank: true},
+		conflicts:  conflictLastWins,
+		validate:   true,
+	}
+	assert.Assert(t, process([]string{input}, buffered, opts, defaultManifestName) == nil)
+
+	streamed := filepath.Join(dir, "streamed")
+	opts.stream = true
+	assert.Assert(t, process([]string{input}, streamed, opts, defaultManifestName) == nil)
+
+	for _, name := range []string{"a.sh", "b.ps1", "c.json", "d.bin", defaultManifestName} {
+		expected, err := ioutil.ReadFile(filepath.Join(buffered, name))
+		assert.Assert(t, err == nil)
+		validateFile(t, filepath.Join("streamed", name), expected)
+	}
+
+	// Validated and binary outputs need their whole content, the others are
+	// encoded to a temporary file in streamDir
+	opts.streamDir = filepath.Join(dir, "spool")
+	assert.Assert(t, os.Mkdir(opts.streamDir, 0755) == nil)
+	output, err := render([][]byte{[]byte(content)}, opts)
+	assert.Assert(t, err == nil)
+	assert.Assert(t, output.get("a.sh").streamed && output.get("a.sh").content == nil)
+	spooled, err := ioutil.ReadFile(output.get("a.sh").spool.name)
+	assert.Assert(t, err == nil)
+	assert.Equal(t, string(spooled), " echo a\r\necho b\r\n")
+	assert.Assert(t, output.get("b.ps1").streamed)
+	assert.Assert(t, !output.get("c.json").streamed)
+	assert.Assert(t, !output.get("d.bin").streamed)
+
+	// Unencodable content is found before anything is written
+	content = "```{file=e.txt encoding=latin1}\n€\n```\n"
+	assert.Assert(t, ioutil.WriteFile(input, []byte(content), 0644) == nil)
+	opts.streamDir = ""
+	err = process([]string{input}, filepath.Join(dir, "failed"), opts, "")
+	assert.Error(t, err, "e.txt: line 1: character '€' can't be represented in latin1")
+	_, err = os.Stat(filepath.Join(dir, "failed"))
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizePath returns a path with forward slashes, and cleans it so all
+// spellings of the same file are the same output, e.g. ./setup.sh and
+// setup.sh. Backslashes are separators on every platform, as they are on
+// windows. Paths with .. are kept as they are, they are rejected anyway.
+func normalizePath(p string) string {
+	p = strings.Replace(strings.TrimSpace(p), `\`, "/", -1)
+	if p == "" || hasDirUp(p) || strings.HasPrefix(p, "//") {
+		return p
+	}
+	return path.Clean(p)
+}
+
+// splitPath splits a path at both / and \, regardless of the platform.
+// filepath.ToSlash() and .Clean() have platform-dependent behavior
+// this is not helpful in this case
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(c rune) bool {
+		return c == '/' || c == '\\'
+	})
+}
+
+func hasDirUp(path string) bool {
+	for _, element := range splitPath(path) {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+var driveLetterRE = regexp.MustCompile(`^[A-Za-z]:`)
+
+// Device names reserved on windows, also if followed by an extension
+var reservedNameRE = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[0-9]|LPT[0-9])(\..*)?$`)
+
+// Characters not allowed in file names on windows, besides control characters
+const invalidChars = `<>:"|?*`
+
+// validatePath checks that a path of an output file is relative, stays
+// within the output directory and is a valid file name on every platform.
+// The same document is treated the same everywhere, even if a path would
+// be fine on the current platform, e.g. C:\temp on unix.
+func validatePath(path string) error {
+	if err := validateRelative(path); err != nil {
+		return err
+	}
+	if hasDirUp(path) {
+		return fmt.Errorf("using .. in paths is not allowed")
+	}
+	return validateElements(path)
+}
+
+func validateRelative(path string) error {
+	switch {
+	case path == "":
+		return fmt.Errorf("empty path")
+	case strings.HasPrefix(path, `\\`) || strings.HasPrefix(path, "//"):
+		return fmt.Errorf("UNC paths are not allowed")
+	case strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`):
+		return fmt.Errorf("absolute paths are not allowed")
+	case driveLetterRE.MatchString(path):
+		return fmt.Errorf("drive letters are not allowed")
+	}
+	return nil
+}
+
+// validateElements checks all elements of path are valid file names
+func validateElements(path string) error {
+	for _, c := range path {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("control characters are not allowed")
+		}
+		if strings.ContainsRune(invalidChars, c) {
+			return fmt.Errorf("character %q is not allowed", c)
+		}
+	}
+
+	for _, element := range splitPath(path) {
+		if element == "." || element == ".." {
+			continue
+		}
+		if strings.HasSuffix(element, ".") || strings.HasSuffix(element, " ") {
+			return fmt.Errorf("trailing dots or spaces are not allowed")
+		}
+		if reservedNameRE.MatchString(element) {
+			return fmt.Errorf("reserved name '%s' is not allowed", element)
+		}
+	}
+	return nil
+}
+
+// isWithin returns true, if path is root or below it. Both have to be
+// absolute.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkSymlinks makes sure writing filename below root doesn't follow a
+// symlink leading outside of root. Files never overwrite a symlink, links
+// replace an existing one.
+func checkSymlinks(root, filename string, kind outputKind) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	elements := strings.Split(filepath.Clean(filepath.FromSlash(filename)), string(filepath.Separator))
+	current := root
+	for i, element := range elements {
+		current = filepath.Join(current, element)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			// Everything below will be created
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if i == len(elements)-1 {
+			switch kind {
+			case outputFile:
+				return fmt.Errorf("refusing to overwrite symlink %s", current)
+			case outputLink:
+				return nil
+			}
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return err
+		}
+		if !isWithin(realRoot, target) {
+			return fmt.Errorf("directory %s is a symlink leading outside of the output directory", current)
+		}
+	}
+	return nil
+}
+
+// foldPath returns the same key for all paths, which end up as the same file
+// on a case-insensitive or normalizing file system, e.g. on windows or macOS.
+func foldPath(p string) string {
+	p = strings.Replace(p, `\`, "/", -1)
+	if !hasDirUp(p) {
+		p = path.Clean(p)
+	}
+	return cases.Fold().String(norm.NFC.String(p))
+}
+
+// findCollisions groups all paths, which collide under case folding or
+// unicode normalization. Groups and the paths within are sorted.
+func findCollisions(paths []string) [][]string {
+	groups := make(map[string][]string)
+	for _, path := range paths {
+		key := foldPath(path)
+		groups[key] = append(groups[key], path)
+	}
+
+	var collisions [][]string
+	for _, group := range groups {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i][0] < collisions[j][0]
+	})
+	return collisions
+}
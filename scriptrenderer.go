@@ -2,14 +2,15 @@ package main
 
 import (
 	"bytes"
-	"path/filepath"
 	"regexp"
-	"strings"
+	"runtime"
+	"sync"
 
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/ast"
-	"github.com/yuin/goldmark/renderer"
-	"github.com/yuin/goldmark/util"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
 )
 
 type lineEndingStyle int8
@@ -34,6 +35,17 @@ func (style lineEndingStyle) String() string {
 	}
 }
 
+func (style lineEndingStyle) bytes() []byte {
+	switch style {
+	case lineEndingCRLF:
+		return []byte{'\r', '\n'}
+	case lineEndingCR:
+		return []byte{'\r'}
+	default:
+		return []byte{'\n'}
+	}
+}
+
 func parseLineEndingStyle(style string) lineEndingStyle {
 	switch style {
 	case "CR":
@@ -47,27 +59,18 @@ func parseLineEndingStyle(style string) lineEndingStyle {
 	}
 }
 
-// IsAbs() returns false for /etc/passwd on windows
-// But if you do mkdir(/etc/passwd) you end up with C:/etc/passwd,
-// this is *not* what we want
-// therefore use filepath and check for / additionally
-func isAbs(path string) bool {
-	return filepath.IsAbs(path) || strings.HasPrefix(path, "/")
-}
-
-// filepath.ToSlash() and .Clean() have platform-dependent behavior
-// this is not helpful in this case
-func hasDirUp(path string) bool {
-	for _, element := range strings.Split(path, "/") {
-		if element == ".." {
-			return true
-		}
+// lineNumber returns the line number of the first line of a block, or
+// the line of the info string for empty fenced code blocks.
+func lineNumber(source []byte, node ast.Node) int {
+	var start int
+	if node.Lines().Len() > 0 {
+		start = node.Lines().At(0).Start
+	} else if fenced, ok := node.(*ast.FencedCodeBlock); ok && fenced.Info != nil {
+		start = fenced.Info.Segment.Start
+	} else {
+		return 0
 	}
-	return false
-}
-
-func normalizePath(path string) string {
-	return filepath.ToSlash(strings.TrimSpace(path))
+	return bytes.Count(source[:start], []byte{'\n'}) + 1
 }
 
 func detectLineEnding(line []byte) lineEndingStyle {
@@ -81,151 +84,351 @@ func detectLineEnding(line []byte) lineEndingStyle {
 	}
 }
 
-type script struct {
-	content    []byte
-	lineEnding lineEndingStyle
+func isBlank(line []byte) bool {
+	return len(bytes.TrimSpace(line)) == 0
 }
 
-func (s *script) append(value []byte) {
-	if s.lineEnding != detectLineEnding(value) {
-		cp := make([]byte, len(value))
-		copy(cp, value)
-		cp = bytes.TrimRight(cp, "\r\n")
-
-		switch s.lineEnding {
-		case lineEndingCRLF:
-			cp = append(cp, []byte{'\r', '\n'}...)
-		case lineEndingCR:
-			cp = append(cp, '\r')
-		default:
-			cp = append(cp, '\n')
+// dedent removes the leading whitespace all non-blank lines have in common.
+// Indentation by the surrounding markdown, e.g. of list items or blockquotes,
+// is already removed by the parser. This is only needed, if the code itself
+// is indented further.
+func dedent(lines [][]byte) [][]byte {
+	var prefix []byte
+	first := true
+	for _, line := range lines {
+		if isBlank(line) {
+			continue
 		}
-		s.content = append(s.content, cp...)
-	} else {
-		s.content = append(s.content, value...)
+		indent := line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+		if first {
+			prefix = indent
+			first = false
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(indent) && prefix[n] == indent[n] {
+			n++
+		}
+		prefix = prefix[:n]
 	}
+
+	result := make([][]byte, 0, len(lines))
+	for _, line := range lines {
+		if bytes.HasPrefix(line, prefix) {
+			line = line[len(prefix):]
+		} else if isBlank(line) {
+			line = bytes.TrimLeft(line, " \t")
+		}
+		result = append(result, line)
+	}
+	return result
 }
 
-func (s *script) initLineEnding(lineEnding lineEndingStyle) {
-	if s.lineEnding == lineEndingUnknown {
-		s.lineEnding = lineEnding
+type script struct {
+	path    string
+	content []byte
+	// Attributes declared by all blocks of this script
+	attrs blockAttributes
+	// Language tag of the first block, and where the lines come from
+	language string
+	origins  []origin
+
+	// Streamed outputs are written to a temporary file while assembling them,
+	// instead of keeping their content. After rendering, the file has the
+	// normalized and encoded content with the SHA-256 checksum sum.
+	streamed bool
+	spool    *spoolFile
+	sum      string
+	// Set when writing, if the file already had this content
+	unchanged bool
+}
+
+// withLineEnding returns line with its line ending replaced by style
+func withLineEnding(line []byte, style lineEndingStyle) []byte {
+	if style == detectLineEnding(line) {
+		return line
 	}
+	cp := make([]byte, len(line))
+	copy(cp, line)
+	cp = bytes.TrimRight(cp, "\r\n")
+	return append(cp, style.bytes()...)
+}
+
+func (s *script) append(value []byte) {
+	s.content = append(s.content, withLineEnding(value, s.attrs.lineEnding)...)
+}
+
+// declare merges the attributes of another block into the script, and
+// returns the conflicts with already declared attributes.
+func (s *script) declare(attrs blockAttributes, policy conflictPolicy) []string {
+	ending := s.attrs.lineEnding
+	conflicts := s.attrs.merge(attrs, policy)
+	if ending != lineEndingUnknown && ending != s.attrs.lineEnding {
+		s.content = bytes.ReplaceAll(s.content, ending.bytes(), s.attrs.lineEnding.bytes())
+	}
+	return conflicts
+}
+
+// block is a code block contributing to an output, as found in one input.
+// Blocks are extracted from every input on its own, and combined to the
+// outputs afterwards.
+type block struct {
+	attrs blockAttributes
+	// Line of the block within the input, and index of the first content
+	// line, which is 1 if the first line is a pragma.
+	line  int
+	start int
+	lines [][]byte
+	// Line ending of the first line, and language of a fenced code block
+	lineEnding lineEndingStyle
+	language   string
+}
+
+// extraction contains everything found in one input
+type extraction struct {
+	blocks []block
+	// Warnings about the input, not yet located in a named input
+	diagnostics []diagnostic
+	// Output directory of the input given in its front matter
+	dir string
 }
 
-type scriptRenderer struct {
-	Output map[string]script
+// extractor parses markdown inputs, and walks their syntax tree to extract
+// the blocks of all outputs. Nothing is rendered, so node kinds added by
+// extensions need no special handling.
+type extractor struct {
+	parser parser.Parser
+	// Result for the input currently extracted
+	result *extraction
+
+	// Attributes from markli comments, by the code block following them
+	hidden map[ast.Node]blockAttributes
 }
 
 var filePragmaRE = regexp.MustCompile(`###\s*FILE(-CR|-LF|-CRLF)?:(.*)\s*$`)
 
 func parsePragma(input []byte) (string, lineEndingStyle) {
-	ending := lineEndingUnknown
-	if match := filePragmaRE.FindSubmatch(input); match != nil {
-		desiredEnding := match[1]
-		if len(desiredEnding) > 0 {
-			// Cut the - from -CRLF
-			ending = parseLineEndingStyle(string(desiredEnding[1:]))
+	return matchPragma(filePragmaRE, input)
+}
+
+func newExtractor() *extractor {
+	md := goldmark.New(goldmark.WithExtensions(extension.GFM))
+	return &extractor{parser: md.Parser()}
+}
+
+// report locates a diagnostic at node, unless it has a line already
+func (e *extractor) report(source []byte, node ast.Node, d diagnostic) {
+	if d.line == 0 {
+		d.line = lineNumber(source, node)
+	}
+	e.result.diagnostics = append(e.result.diagnostics, d)
+}
+
+func isCodeBlock(node ast.Node) bool {
+	return node != nil && (node.Kind() == ast.KindCodeBlock || node.Kind() == ast.KindFencedCodeBlock)
+}
+
+func htmlBlockContent(source []byte, node ast.Node) []byte {
+	var html []byte
+	for i := 0; i < node.Lines().Len(); i++ {
+		line := node.Lines().At(i)
+		html = append(html, line.Value(source)...)
+	}
+	if block := node.(*ast.HTMLBlock); block.HasClosure() {
+		html = append(html, block.ClosureLine.Value(source)...)
+	}
+	return html
+}
+
+// visitHTMLBlock looks for a hidden pragma in a markli HTML comment and
+// attaches its attributes to the code block directly following it.
+func (e *extractor) visitHTMLBlock(source []byte, node ast.Node) {
+	attrs, warnings, ok := parseHiddenPragma(htmlBlockContent(source, node))
+	for _, d := range warnings {
+		e.report(source, node, d)
+	}
+	if !ok {
+		return
+	}
+	if !isCodeBlock(node.NextSibling()) {
+		e.report(source, node, newDiagnostic(severityWarning, codeOrphanPragma,
+			"markli comment is not followed by a code block, ignoring it"))
+		return
+	}
+	e.hidden[node.NextSibling()] = attrs
+}
+
+// blockAttributes returns the attributes of a code block and the index of its
+// first content line. Attributes from a preceding markli comment take
+// precedence over attributes in the info string of a fenced code block, which
+// take precedence over a FILE pragma on the first line.
+func (e *extractor) blockAttributes(source []byte, node ast.Node) (blockAttributes, int) {
+	if attrs, ok := e.hidden[node]; ok {
+		return attrs, 0
+	}
+
+	language := ""
+	if fenced, ok := node.(*ast.FencedCodeBlock); ok && fenced.Info != nil {
+		info := fenced.Info.Segment
+		attrs, warnings := parseInfoAttributes(info.Value(source))
+		for _, d := range warnings {
+			e.report(source, node, d)
 		}
-		p := normalizePath(string(match[2]))
-		return p, ending
-	}
-	return "", ending
-}
-
-func newScriptRenderer(rendered map[string]script) *scriptRenderer {
-	return &scriptRenderer{Output: rendered}
-}
-
-func (r *scriptRenderer) renderNoop(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
-	return ast.WalkContinue, nil
-}
-
-func (r *scriptRenderer) renderCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
-	if entering {
-		path := ""
-		for i := 0; i < node.Lines().Len(); i++ {
-			line := node.Lines().At(i)
-			value := line.Value(source)
-			ending := detectLineEnding(value)
-			if i == 0 {
-				if p, desiredEnding := parsePragma(value); p != "" {
-					if desiredEnding != lineEndingUnknown {
-						ending = desiredEnding
-					}
-					switch {
-					case p == "":
-						log.verbosef("Warning: ingoring empty path\n")
-					case isAbs(p):
-						log.verbosef("Warning: absolute paths are not allowed, ignoring path: %s\n", p)
-					case hasDirUp(p):
-						log.verbosef("Warning: using .. in paths is not allowed, ignoring path: %s\n", p)
-					default:
-						// accept this path
-						path = p
-					}
-				}
-				if path == "" {
-					return ast.WalkContinue, nil
-				}
-				log.verbose3f("Adding script '%s' with line ending '%s'\n", path, ending.String())
-				sc := r.Output[path]
-				sc.initLineEnding(ending)
-				r.Output[path] = sc
-			} else {
-				sc := r.Output[path]
-				sc.append(value)
-				r.Output[path] = sc
-			}
+		if attrs.path != "" {
+			return attrs, 0
 		}
+		language = string(fenced.Language(source))
+	}
+
+	var attrs blockAttributes
+	if node.Lines().Len() > 0 {
+		line := node.Lines().At(0)
+		attrs.path, attrs.lineEnding = parseLanguagePragma(line.Value(source), language)
 	}
-	return ast.WalkContinue, nil
+	return attrs, 1
 }
 
-func (r *scriptRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
-	// Things we care for
-	reg.Register(ast.KindCodeBlock, r.renderCodeBlock)
-	reg.Register(ast.KindFencedCodeBlock, r.renderCodeBlock)
+// reportPath warns about an output which is skipped because of err
+func (e *extractor) reportPath(source []byte, node ast.Node, code string, p string, err error) {
+	d := newDiagnostic(severityWarning, code, "%v, ignoring it", err)
+	d.output = p
+	d.skipsBlock = true
+	e.report(source, node, d)
+}
 
-	// Everything else get's ignored
-	reg.Register(ast.KindAutoLink, r.renderNoop)
-	reg.Register(ast.KindBlockquote, r.renderNoop)
-	reg.Register(ast.KindDocument, r.renderNoop)
-	reg.Register(ast.KindEmphasis, r.renderNoop)
-	reg.Register(ast.KindHTMLBlock, r.renderNoop)
-	reg.Register(ast.KindHeading, r.renderNoop)
-	reg.Register(ast.KindImage, r.renderNoop)
-	reg.Register(ast.KindLink, r.renderNoop)
-	reg.Register(ast.KindList, r.renderNoop)
-	reg.Register(ast.KindListItem, r.renderNoop)
-	reg.Register(ast.KindParagraph, r.renderNoop)
-	reg.Register(ast.KindRawHTML, r.renderNoop)
-	reg.Register(ast.KindString, r.renderNoop)
-	reg.Register(ast.KindText, r.renderNoop)
-	reg.Register(ast.KindTextBlock, r.renderNoop)
-	reg.Register(ast.KindThematicBreak, r.renderNoop)
+// addLayout adds a directory or symlink
+func (e *extractor) addLayout(source []byte, node ast.Node, attrs blockAttributes) {
+	p := attrs.path
+	if err := validatePath(p); err != nil {
+		e.reportPath(source, node, codeInvalidPath, p, err)
+		return
+	}
+	if attrs.kind == outputLink {
+		if err := validateLinkTarget(p, attrs.target); err != nil {
+			e.reportPath(source, node, codeInvalidLink, p, err)
+			return
+		}
+	}
+	e.result.blocks = append(e.result.blocks, block{attrs: attrs, line: lineNumber(source, node)})
 }
 
-type scriptBlocks struct {
-	rendered map[string]script
-	renderer *scriptRenderer
+func (e *extractor) visitCodeBlock(source []byte, node ast.Node) {
+	layout, warnings := parseLayoutBlock(source, node)
+	for _, d := range warnings {
+		e.report(source, node, d)
+	}
+	if layout != nil {
+		for _, attrs := range layout {
+			e.addLayout(source, node, attrs)
+		}
+		return
+	}
+
+	attrs, start := e.blockAttributes(source, node)
+	if attrs.path == "" {
+		return
+	}
+	if attrs.kind != outputFile {
+		e.addLayout(source, node, attrs)
+		return
+	}
+
+	p := attrs.path
+	if err := validatePath(p); err != nil {
+		e.reportPath(source, node, codeInvalidPath, p, err)
+		return
+	}
+
+	b := block{
+		attrs:      attrs,
+		line:       lineNumber(source, node),
+		start:      start,
+		lineEnding: lineEndingLF,
+	}
+	for i := 0; i < node.Lines().Len(); i++ {
+		line := node.Lines().At(i)
+		if i == 0 {
+			b.lineEnding = detectLineEnding(line.Value(source))
+		}
+		if i >= start {
+			b.lines = append(b.lines, line.Value(source))
+		}
+	}
+	if fenced, ok := node.(*ast.FencedCodeBlock); ok {
+		b.language = string(fenced.Language(source))
+	}
+	e.result.blocks = append(e.result.blocks, b)
 }
 
-func newScriptBlocks(rendered map[string]script) scriptBlocks {
-	if rendered == nil {
-		panic("output struct must be initialized")
+// extract returns the blocks of all outputs in an input
+func (e *extractor) extract(input []byte) extraction {
+	e.result = &extraction{}
+	e.hidden = make(map[ast.Node]blockAttributes)
+
+	var warnings []diagnostic
+	e.result.dir, warnings = parseFrontMatter(input)
+	e.result.diagnostics = append(e.result.diagnostics, warnings...)
+
+	doc := e.parser.Parse(text.NewReader(input))
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node.Kind() {
+		case ast.KindHTMLBlock:
+			e.visitHTMLBlock(input, node)
+		case ast.KindCodeBlock, ast.KindFencedCodeBlock:
+			e.visitCodeBlock(input, node)
+		}
+		return ast.WalkContinue, nil
+	})
+	return *e.result
+}
+
+// extracted is the result of extracting the blocks of one input
+type extracted struct {
+	extraction
+	// Set if the blocks were taken from the cache, or storing them failed
+	cached   bool
+	cacheErr error
+}
+
+// extractInput extracts the blocks of one input, or takes them from the cache
+func extractInput(ext *extractor, input []byte, cache *renderCache) extracted {
+	var result extracted
+	if result.extraction, result.cached = cache.load(input); result.cached {
+		return result
 	}
-	e := scriptBlocks{}
-	e.rendered = rendered
-	return e
+	result.extraction = ext.extract(input)
+	result.cacheErr = cache.store(input, result.extraction)
+	return result
 }
 
-func (e *scriptBlocks) Extend(m goldmark.Markdown) {
-	if e.renderer != nil {
-		panic("scriptBlocks can only be used once")
+// extractAll extracts the blocks of all inputs concurrently, using one
+// extractor per CPU. The results are in the order of the inputs.
+func extractAll(inputs [][]byte, cache *renderCache) []extracted {
+	results := make([]extracted, len(inputs))
+	workers := runtime.NumCPU()
+	if workers > len(inputs) {
+		workers = len(inputs)
 	}
-	e.renderer = newScriptRenderer(e.rendered)
 
-	m.Renderer().AddOptions(renderer.WithNodeRenderers(
-		util.Prioritized(e.renderer, 500),
-	))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ext := newExtractor()
+			for i := range indices {
+				results[i] = extractInput(ext, inputs[i], cache)
+			}
+		}()
+	}
+	for i := range inputs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// lineWriter normalizes whitespace and encodes an output line by line, the
+// result is the same as of whitespaceOptions.normalize and encode on the
+// whole content.
+type lineWriter struct {
+	w        io.Writer
+	opts     whitespaceOptions
+	ending   []byte
+	encoding textEncoding
+
+	// Incomplete last line, and blank lines held back for final-newline
+	partial []byte
+	blank   [][]byte
+	// Set once anything was written to the lineWriter, and once a line was
+	// passed on
+	written bool
+	started bool
+	// Line number for encoding errors, and buffer for the transcoded lines
+	line    int
+	encoded bytes.Buffer
+	err     error
+}
+
+func newLineWriter(w io.Writer, opts whitespaceOptions, ending []byte, encoding textEncoding) *lineWriter {
+	lw := &lineWriter{w: w, opts: opts, ending: ending, encoding: encoding, line: 1}
+	if bom := encoding.byteOrderMark(); bom != nil {
+		_, lw.err = w.Write(bom)
+	}
+	return lw
+}
+
+// output encodes a part of the normalized content, and passes it on
+func (lw *lineWriter) output(data []byte) {
+	if lw.err != nil || len(data) == 0 {
+		return
+	}
+	if lw.encoding.isUTF8() {
+		_, lw.err = lw.w.Write(data)
+		return
+	}
+	lw.encoded.Reset()
+	if lw.line, lw.err = lw.encoding.encodeText(&lw.encoded, data, lw.line); lw.err == nil {
+		_, lw.err = lw.w.Write(lw.encoded.Bytes())
+	}
+}
+
+func (lw *lineWriter) normalize(line []byte) []byte {
+	if lw.opts.expandTabs > 0 {
+		line = expandTabs(line, lw.opts.expandTabs)
+	}
+	if lw.opts.unexpandTabs > 0 {
+		line = unexpandTabs(line, lw.opts.unexpandTabs)
+	}
+	if lw.opts.trimTrailing {
+		line = bytes.TrimRight(line, " \t")
+	}
+	return line
+}
+
+// writeLine passes on a line without its line ending, which is added
+// unless the line is the last one and final is false.
+func (lw *lineWriter) writeLine(line []byte, final bool) {
+	line = lw.normalize(line)
+	if lw.opts.stripLeadingBlank && !lw.started && isBlank(line) {
+		return
+	}
+	if lw.opts.finalNewline {
+		if isBlank(line) {
+			lw.blank = append(lw.blank, append([]byte(nil), line...))
+			return
+		}
+		for _, blank := range lw.blank {
+			lw.output(blank)
+			lw.output(lw.ending)
+		}
+		lw.blank = lw.blank[:0]
+		final = true
+	}
+	lw.started = true
+	lw.output(line)
+	if final {
+		lw.output(lw.ending)
+	}
+}
+
+// Write adds content with the line ending of the output
+func (lw *lineWriter) Write(data []byte) (int, error) {
+	if len(data) > 0 {
+		lw.written = true
+	}
+	lw.partial = append(lw.partial, data...)
+	start := 0
+	for {
+		i := bytes.Index(lw.partial[start:], lw.ending)
+		if i < 0 {
+			break
+		}
+		lw.writeLine(lw.partial[start:start+i], true)
+		start += i + len(lw.ending)
+	}
+	// Move the incomplete line to the start, so the buffer doesn't grow
+	lw.partial = lw.partial[:copy(lw.partial, lw.partial[start:])]
+	return len(data), lw.err
+}
+
+// Close writes the last line, all blank lines held back are dropped
+func (lw *lineWriter) Close() error {
+	if len(lw.partial) > 0 {
+		lw.writeLine(lw.partial, false)
+	} else if lw.written && !lw.started && !lw.opts.finalNewline {
+		// Content of blank lines only, which were all stripped
+		lw.output(lw.ending)
+	}
+	return lw.err
+}
+
+// spoolFile is the temporary file of a streamed output. While assembling,
+// the lines of its blocks are appended with LF line endings, encode then
+// replaces them by the normalized and encoded content.
+type spoolFile struct {
+	name string
+	// Number of lines appended so far
+	lines int
+}
+
+func newSpoolFile(dir string) (*spoolFile, error) {
+	f, err := ioutil.TempFile(dir, "spool-")
+	if err != nil {
+		return nil, err
+	}
+	return &spoolFile{name: f.Name()}, f.Close()
+}
+
+// append adds the lines of a block using the buffer w. The file is only
+// open while appending, so there can be more outputs than open files.
+func (s *spoolFile) append(w *bufio.Writer, lines [][]byte) error {
+	f, err := os.OpenFile(s.name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	w.Reset(f)
+	for _, line := range lines {
+		// Errors are kept by the buffer and returned by Flush
+		_, _ = w.Write(withLineEnding(line, lineEndingLF))
+	}
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	s.lines += len(lines)
+	return err
+}
+
+// encode normalizes and encodes the appended lines to a new temporary file,
+// which replaces the spooled lines, and returns the SHA-256 checksum of the
+// result. Errors other than *os.PathError are those of encoding the content.
+func (s *spoolFile) encode(opts whitespaceOptions, style lineEndingStyle, encoding textEncoding) (string, error) {
+	in, err := os.Open(s.name)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(s.name), "output-")
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	w := bufio.NewWriterSize(out, 64*1024)
+	err = encodeLines(newLineWriter(io.MultiWriter(w, h), opts, style.bytes(), encoding),
+		bufio.NewReaderSize(in, 64*1024), style.bytes())
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	os.Remove(s.name)
+	s.name = out.Name()
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// encodeLines passes all lines read from r to lw, with their LF line ending
+// replaced by ending.
+func encodeLines(lw *lineWriter, r *bufio.Reader, ending []byte) error {
+	for {
+		// Lines longer than the buffer are passed on in pieces
+		chunk, err := r.ReadSlice('\n')
+		if n := len(chunk); n > 0 && chunk[n-1] == '\n' {
+			if _, werr := lw.Write(chunk[:n-1]); werr != nil {
+				return werr
+			}
+			chunk = ending
+		}
+		if _, werr := lw.Write(chunk); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return lw.Close()
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// writeStreamed copies the encoded content of a streamed output to the file
+// at path
+func writeStreamed(path string, sc script, mode os.FileMode) error {
+	in, err := os.Open(sc.spool.name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// isUnchanged is true if the file at path has the content of an output
+func isUnchanged(path string, sc script) bool {
+	if !sc.streamed {
+		existing, err := ioutil.ReadFile(path)
+		return err == nil && bytes.Equal(existing, sc.content)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == sc.sum
+}
@@ -23,10 +23,10 @@ func assertOutput(t *testing.T, outBytes []byte, reference string) {
 }
 
 func lineEndingTestHelper(t *testing.T, input string, expectedFilename string, expected string) {
-	output, err := render([][]byte{[]byte(input)})
+	output, err := render([][]byte{[]byte(input)}, renderOptions{})
 	assert.Assert(t, err == nil)
 	assert.Assert(t, len(output) == 1)
-	assertOutput(t, output[expectedFilename], expected)
+	assertOutput(t, output.get(expectedFilename).content, expected)
 }
 
 func readExampleFile(name string) [][]byte {
@@ -41,3 +41,9 @@ func readExampleFile(name string) [][]byte {
 	ret = append(ret, bytes)
 	return ret
 }
+
+// get returns the output with the given path, or an empty script
+func (l outputList) get(path string) script {
+	sc, _ := l.find(path)
+	return sc
+}
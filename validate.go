@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// origin maps lines of an output back to the markdown block they come from
+type origin struct {
+	// First line of the output added by the block
+	line int
+	// Name of the input, and the line within it
+	input     string
+	inputLine int
+}
+
+func (s *script) shiftOrigins(n int) {
+	for i := range s.origins {
+		s.origins[i].line += n
+	}
+}
+
+// locate returns the input and line within it of a line of the output
+func (s *script) locate(line int) (string, int) {
+	var found *origin
+	for i := range s.origins {
+		if s.origins[i].line > line {
+			break
+		}
+		found = &s.origins[i]
+	}
+	if found == nil {
+		return "", 0
+	}
+	return found.input, found.inputLine + line - found.line
+}
+
+// syntaxError is an error of a syntax validator, line is the line within
+// the output or 0 if unknown.
+type syntaxError struct {
+	line int
+	msg  string
+}
+
+func (e *syntaxError) Error() string {
+	return e.msg
+}
+
+// lineOf returns the line of a byte offset within content
+func lineOf(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte{'\n'}) + 1
+}
+
+func validateJSON(content []byte) error {
+	var value interface{}
+	err := json.Unmarshal(content, &value)
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &syntax):
+		return &syntaxError{lineOf(content, syntax.Offset), err.Error()}
+	case errors.As(err, &typeErr):
+		return &syntaxError{lineOf(content, typeErr.Offset), err.Error()}
+	default:
+		return &syntaxError{0, err.Error()}
+	}
+}
+
+var yamlLineRE = regexp.MustCompile(`^yaml: line (\d+): `)
+
+func validateYAML(content []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			msg := err.Error()
+			line := 0
+			if match := yamlLineRE.FindStringSubmatch(msg); match != nil {
+				line, _ = strconv.Atoi(match[1])
+				msg = msg[len(match[0]):]
+			}
+			return &syntaxError{line, strings.TrimPrefix(msg, "yaml: ")}
+		}
+	}
+}
+
+var tomlPrefixRE = regexp.MustCompile(`^toml: line \d+( \(last key [^)]*\))?: `)
+
+func validateTOML(content []byte) error {
+	var value map[string]interface{}
+	_, err := toml.Decode(string(content), &value)
+	var parseErr toml.ParseError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &parseErr):
+		msg := tomlPrefixRE.ReplaceAllString(parseErr.Error(), "")
+		return &syntaxError{parseErr.Position.Line, msg}
+	default:
+		return &syntaxError{0, err.Error()}
+	}
+}
+
+func validateXML(content []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	// The encoding was checked already, any charset is fine here
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		var syntax *xml.SyntaxError
+		if errors.As(err, &syntax) {
+			return &syntaxError{syntax.Line, syntax.Msg}
+		}
+		if err != nil {
+			return &syntaxError{0, err.Error()}
+		}
+	}
+}
+
+type syntaxValidator struct {
+	name     string
+	validate func([]byte) error
+}
+
+var (
+	jsonValidator = syntaxValidator{"JSON", validateJSON}
+	yamlValidator = syntaxValidator{"YAML", validateYAML}
+	tomlValidator = syntaxValidator{"TOML", validateTOML}
+	xmlValidator  = syntaxValidator{"XML", validateXML}
+)
+
+// Validators by file extension, and by language tag of the code block
+var (
+	extensionValidators = map[string]syntaxValidator{
+		".json": jsonValidator,
+		".yaml": yamlValidator,
+		".yml":  yamlValidator,
+		".toml": tomlValidator,
+		".xml":  xmlValidator,
+		".svg":  xmlValidator,
+	}
+	languageValidators = map[string]syntaxValidator{
+		"json": jsonValidator,
+		"yaml": yamlValidator,
+		"yml":  yamlValidator,
+		"toml": tomlValidator,
+		"xml":  xmlValidator,
+		"svg":  xmlValidator,
+	}
+)
+
+// findSyntaxValidator returns the validator for the format of an output, the
+// bool is false if it has none.
+func findSyntaxValidator(sc script) (syntaxValidator, bool) {
+	ext := strings.ToLower(path.Ext(strings.Replace(sc.path, `\`, "/", -1)))
+	if validator, ok := extensionValidators[ext]; ok {
+		return validator, true
+	}
+	validator, ok := languageValidators[strings.ToLower(sc.language)]
+	return validator, ok
+}
+
+// validateSyntax parses an output as JSON, YAML, TOML or XML, depending on
+// its file extension or else the language of its first block. Errors are
+// located at the markdown line they come from.
+func validateSyntax(sc script) error {
+	validator, ok := findSyntaxValidator(sc)
+	if !ok {
+		return nil
+	}
+
+	// Line numbers are counted by \n, which is not part of CR line endings
+	content := sc.content
+	if sc.attrs.lineEnding == lineEndingCR {
+		content = bytes.ReplaceAll(content, []byte{'\r'}, []byte{'\n'})
+	}
+	log.verbose3f("Validating %s as %s\n", sc.path, validator.name)
+
+	err := validator.validate(content)
+	if err == nil {
+		return nil
+	}
+
+	d := newDiagnostic(severityError, codeInvalidSyntax, "invalid %s: %v", validator.name, err)
+	d.output = sc.path
+	if syntax, ok := err.(*syntaxError); ok && syntax.line > 0 {
+		d.input, d.line = sc.locate(syntax.line)
+		if d.input == "" {
+			d.message = fmt.Sprintf("line %d: %s", syntax.line, d.message)
+		}
+	}
+	return d
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// whitespaceOptions control the normalization of whitespace in output files.
+type whitespaceOptions struct {
+	// Ensure the file ends with exactly one line ending
+	finalNewline bool
+	// Remove whitespace at the end of every line
+	trimTrailing bool
+	// Remove blank lines at the start of the file
+	stripLeadingBlank bool
+	// Replace tabs by spaces, using the given tab width
+	expandTabs int
+	// Replace leading spaces by tabs, using the given tab width
+	unexpandTabs int
+}
+
+// whitespaceAttributes override the global whitespaceOptions for a single
+// file, nil means the attribute was not given.
+type whitespaceAttributes struct {
+	finalNewline      *bool
+	trimTrailing      *bool
+	stripLeadingBlank *bool
+	expandTabs        *int
+	unexpandTabs      *int
+}
+
+func parseBoolAttribute(key, value string) (*bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s '%s'", key, value)
+	}
+	return &b, nil
+}
+
+func parseTabWidthAttribute(key, value string) (*int, error) {
+	width, err := strconv.Atoi(value)
+	if err != nil || width < 0 {
+		return nil, fmt.Errorf("invalid value for %s '%s'", key, value)
+	}
+	return &width, nil
+}
+
+// set parses a whitespace attribute, the bool result is false if key is
+// not a whitespace attribute.
+func (a *whitespaceAttributes) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "final-newline":
+		a.finalNewline, err = parseBoolAttribute(key, value)
+	case "trim-trailing":
+		a.trimTrailing, err = parseBoolAttribute(key, value)
+	case "strip-leading-blank":
+		a.stripLeadingBlank, err = parseBoolAttribute(key, value)
+	case "expand-tabs":
+		a.expandTabs, err = parseTabWidthAttribute(key, value)
+	case "unexpand-tabs":
+		a.unexpandTabs, err = parseTabWidthAttribute(key, value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (a *whitespaceAttributes) values(values map[string]string) {
+	if a.finalNewline != nil {
+		values["final-newline"] = strconv.FormatBool(*a.finalNewline)
+	}
+	if a.trimTrailing != nil {
+		values["trim-trailing"] = strconv.FormatBool(*a.trimTrailing)
+	}
+	if a.stripLeadingBlank != nil {
+		values["strip-leading-blank"] = strconv.FormatBool(*a.stripLeadingBlank)
+	}
+	if a.expandTabs != nil {
+		values["expand-tabs"] = strconv.Itoa(*a.expandTabs)
+	}
+	if a.unexpandTabs != nil {
+		values["unexpand-tabs"] = strconv.Itoa(*a.unexpandTabs)
+	}
+}
+
+func (a whitespaceAttributes) apply(opts whitespaceOptions) whitespaceOptions {
+	if a.finalNewline != nil {
+		opts.finalNewline = *a.finalNewline
+	}
+	if a.trimTrailing != nil {
+		opts.trimTrailing = *a.trimTrailing
+	}
+	if a.stripLeadingBlank != nil {
+		opts.stripLeadingBlank = *a.stripLeadingBlank
+	}
+	if a.expandTabs != nil {
+		opts.expandTabs = *a.expandTabs
+	}
+	if a.unexpandTabs != nil {
+		opts.unexpandTabs = *a.unexpandTabs
+	}
+	return opts
+}
+
+func expandTabs(line []byte, width int) []byte {
+	var result []byte
+	column := 0
+	for _, c := range line {
+		if c == '\t' {
+			spaces := width - column%width
+			result = append(result, bytes.Repeat([]byte{' '}, spaces)...)
+			column += spaces
+			continue
+		}
+		result = append(result, c)
+		column++
+	}
+	return result
+}
+
+func unexpandTabs(line []byte, width int) []byte {
+	indent := 0
+	for indent < len(line) && line[indent] == ' ' {
+		indent++
+	}
+	tabs := bytes.Repeat([]byte{'\t'}, indent/width)
+	return append(tabs, line[indent-indent%width:]...)
+}
+
+// leadingBlankLines counts the blank lines at the start of content
+func leadingBlankLines(content []byte, ending []byte) int {
+	n := 0
+	for _, line := range bytes.SplitAfter(content, ending) {
+		if len(line) == 0 || !isBlank(line) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// normalize applies the whitespace options to content, which uses the
+// given line ending.
+func (opts whitespaceOptions) normalize(content []byte, ending []byte) []byte {
+	if len(content) == 0 {
+		return content
+	}
+
+	lines := bytes.Split(content, ending)
+	// content usually ends with a line ending, this results in an empty last element
+	hasFinal := bytes.HasSuffix(content, ending)
+	if hasFinal {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i, line := range lines {
+		if opts.expandTabs > 0 {
+			line = expandTabs(line, opts.expandTabs)
+		}
+		if opts.unexpandTabs > 0 {
+			line = unexpandTabs(line, opts.unexpandTabs)
+		}
+		if opts.trimTrailing {
+			line = bytes.TrimRight(line, " \t")
+		}
+		lines[i] = line
+	}
+
+	if opts.stripLeadingBlank {
+		for len(lines) > 0 && isBlank(lines[0]) {
+			lines = lines[1:]
+		}
+	}
+
+	if opts.finalNewline {
+		for len(lines) > 0 && isBlank(lines[len(lines)-1]) {
+			lines = lines[:len(lines)-1]
+		}
+		hasFinal = len(lines) > 0
+	}
+
+	result := bytes.Join(lines, ending)
+	if hasFinal {
+		result = append(result, ending...)
+	}
+	return result
+}